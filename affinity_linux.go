@@ -0,0 +1,40 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const affinitySupported = true
+
+// Lock the calling goroutine to its OS thread and pin the thread to
+// one of the CPUs the process is allowed to run on. The thread is never
+// unlocked, so the runtime discards it when the goroutine exits.
+func pinWorker(worker int) error {
+	var allowed unix.CPUSet
+	err := unix.SchedGetaffinity(0, &allowed)
+	if err != nil {
+		return err
+	}
+	var cpus []int
+	for i := 0; len(cpus) < allowed.Count(); i++ {
+		if allowed.IsSet(i) {
+			cpus = append(cpus, i)
+		}
+	}
+	if len(cpus) == 0 {
+		return nil
+	}
+	runtime.LockOSThread()
+	var set unix.CPUSet
+	set.Set(cpus[worker%len(cpus)])
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+const affinitySupported = false
+
+// CPU affinity is Linux only
+func pinWorker(worker int) error {
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An open destination. With -atomic the data is written to a staging file
+// that replaces the destination only once the copy succeeded.
+type target struct {
+	*os.File
+	destination string
+	staged      bool
+	tmpName     string // name of the staging file, empty while anonymous
+}
+
+// Open the destination for writing, or a staging file for it with -atomic.
+// Staging files are anonymous O_TMPFILE files where supported, so nothing
+// is left behind by a crash, and hidden temporary files elsewhere.
+func openTarget(destination string, flags int, mode os.FileMode) (*target, error) {
+	if !*atomicWrite {
+		f, err := openDestination(destination, flags, mode)
+		if err != nil {
+			return nil, err
+		}
+		return &target{File: f, destination: destination}, nil
+	}
+
+	// Replace the target of a symlink, unless the link itself is replaced
+	if !*noDerefDest {
+		if resolved, err := filepath.EvalSymlinks(destination); err == nil {
+			destination = resolved
+		}
+	}
+	if info, err := os.Lstat(destination); err == nil {
+		if !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+			return nil, fmt.Errorf("-atomic needs a regular file destination, %s is not", destination)
+		}
+		if *noClobber {
+			return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+		}
+		if !*force && !confirm(destination) {
+			return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+		}
+	}
+
+	f, err := openTmpfile(filepath.Dir(destination), destination, mode)
+	if err == nil {
+		return &target{File: f, destination: destination, staged: true}, nil
+	}
+	name, err := tempName(destination)
+	if err != nil {
+		return nil, err
+	}
+	f, err = os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return nil, err
+	}
+	return &target{File: f, destination: destination, staged: true, tmpName: name}, nil
+}
+
+// Close the destination after a copy that ended with err. A staging file
+// is synced and moved into place when the copy succeeded, or removed.
+func (t *target) finish(err error) error {
+	if t.staged {
+		// The data must be on disk before the destination name points to it
+		if err == nil {
+			err = t.Sync()
+		}
+		if err == nil {
+			err = t.commit()
+		}
+		if err != nil && t.tmpName != "" {
+			os.Remove(t.tmpName)
+		}
+	}
+	if cerr := t.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Move a staging file into place, replacing the destination
+func (t *target) commit() error {
+	// Links can't replace a file, anonymous files get a name to rename first
+	if t.tmpName == "" {
+		name, err := tempName(t.destination)
+		if err != nil {
+			return err
+		}
+		err = linkTmpfile(t.File, name)
+		if err != nil {
+			return err
+		}
+		t.tmpName = name
+	}
+	return os.Rename(t.tmpName, t.destination)
+}
+
+// Get a random hidden name next to the destination for a staging file.
+// The random suffix keeps concurrent copies to the same destination and
+// the leftovers of crashed ones from colliding.
+func tempName(destination string) (string, error) {
+	buf := make([]byte, tempSuffixLen/2)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	dir, base := filepath.Split(destination)
+	return filepath.Join(dir, "."+base+tempInfix+hex.EncodeToString(buf)), nil
+}
+
+// Staging file names are .<name>.pcp-<random hex suffix>
+const (
+	tempInfix     = ".pcp-"
+	tempSuffixLen = 16
+)
+
+// Directories already cleaned of stale staging files
+var cleanedDirs sync.Map
+
+// Remove the staging files in dir left behind by copies that crashed more
+// than age ago. Files of copies still running are younger and kept.
+func cleanStaleTemps(dir string, age time.Duration) error {
+	if _, done := cleanedDirs.LoadOrStore(dir, true); done {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !isTempName(e.Name()) || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < age {
+			continue
+		}
+		err = os.Remove(filepath.Join(dir, e.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		log.Printf("removed stale staging file %s", filepath.Join(dir, e.Name()))
+	}
+	return nil
+}
+
+// Check if a file name matches the staging file names of pcp
+func isTempName(name string) bool {
+	i := strings.LastIndex(name, tempInfix)
+	if !strings.HasPrefix(name, ".") || i < 1 || len(name)-i-len(tempInfix) != tempSuffixLen {
+		return false
+	}
+	_, err := hex.DecodeString(name[i+len(tempInfix):])
+	return err == nil
+}
@@ -0,0 +1,25 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// O_TMPFILE is Linux only, staging files get a temporary name instead
+func openTmpfile(dir, name string, mode os.FileMode) (*os.File, error) {
+	return nil, unix.ENOTSUP
+}
+
+func linkTmpfile(f *os.File, name string) error {
+	return unix.ENOTSUP
+}
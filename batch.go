@@ -0,0 +1,300 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A copy job read from a list file
+type job struct {
+	line        int
+	source      string
+	destination string
+}
+
+// A failed copy job
+type failure struct {
+	job
+	err error
+}
+
+// Copy the files of a list, sharing the thread budget between parallel jobs
+func batchCopy(list string) error {
+	jobs, err := readJobs(list)
+	if err != nil {
+		return err
+	}
+	err = checkInodes(jobs)
+	if err != nil {
+		return err
+	}
+
+	var cp *checkpoint
+	if *checkpointFile != "" && !*dryRun {
+		cp, err = openCheckpoint(*checkpointFile, *resume)
+		if err != nil {
+			return err
+		}
+	}
+
+	parallel := *fileJobs
+	if parallel <= 0 {
+		parallel = 1
+	}
+	// Each copy keeps its source and destination open, and a hook the few
+	// descriptors of the command it starts once they are closed. They share
+	// what is left by the descriptors pcp keeps open itself, like the
+	// standard streams, the checkpoint and -progress-fd.
+	perCopy := 2
+	if *onComplete != "" || *onError != "" {
+		perCopy = 4
+	}
+	limit, err := openFilesLimit()
+	if err != nil {
+		return err
+	}
+	if avail := limit - openFiles(); parallel > avail/perCopy {
+		parallel = avail / perCopy
+		if parallel <= 0 {
+			parallel = 1
+		}
+		log.Printf("limiting -j to %d parallel copies to stay within %d open files", parallel, limit)
+	}
+	perFile := *threads / parallel
+	if perFile <= 0 {
+		perFile = 1
+	}
+
+	var failures []failure
+	var failuresLock sync.Mutex
+	var copied, skipped, bytes atomic.Int64
+	var stop atomic.Bool
+	var printLock sync.Mutex
+	start := time.Now()
+	work := make(chan job)
+	wg := new(sync.WaitGroup)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range work {
+				if stop.Load() {
+					continue
+				}
+				if cp != nil && cp.completed(j) {
+					skipped.Add(1)
+					continue
+				}
+				res, err := copyFile(j.source, j.destination, perFile)
+				err = runHook(j.source, j.destination, res, err)
+				if errors.Is(err, errNotOverwritten) || errors.Is(err, errUpToDate) {
+					skipped.Add(1)
+					continue
+				}
+				if err != nil {
+					log.Printf("line %d: %v", j.line, err)
+					failuresLock.Lock()
+					failures = append(failures, failure{j, err})
+					tooMany := *maxErrors > 0 && len(failures) >= *maxErrors
+					failuresLock.Unlock()
+					if *stopOnError || tooMany {
+						stop.Store(true)
+					}
+					continue
+				}
+				copied.Add(1)
+				bytes.Add(res.BytesCopied)
+				if cp != nil {
+					if err := cp.record(j); err != nil {
+						log.Printf("line %d: checkpoint: %v", j.line, err)
+					}
+				}
+				if outputFormat != nil {
+					printLock.Lock()
+					res.print(os.Stdout)
+					printLock.Unlock()
+					continue
+				}
+				if *dryRun {
+					fmt.Println(res.Plan)
+					continue
+				}
+				fmt.Println(j.source, "->", j.destination)
+			}
+		}()
+	}
+	for _, j := range jobs {
+		if stop.Load() {
+			break
+		}
+		work <- j
+	}
+	close(work)
+	wg.Wait()
+	if cp != nil {
+		if err := cp.close(len(failures) == 0); err != nil {
+			log.Println("checkpoint:", err)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Files copied:  %d\n", copied.Load())
+	elapsed := time.Since(start)
+	if *humanReadable {
+		fmt.Fprintf(os.Stderr, "Bytes copied:  %s (%.1f MiB/s)\n", humanSize(bytes.Load()),
+			float64(bytes.Load())/(1<<20)/elapsed.Seconds())
+	} else {
+		fmt.Fprintf(os.Stderr, "Bytes copied:  %d\n", bytes.Load())
+	}
+	fmt.Fprintf(os.Stderr, "Files skipped: %d\n", skipped.Load())
+	fmt.Fprintf(os.Stderr, "Files failed:  %d\n", len(failures))
+	fmt.Fprintf(os.Stderr, "Duration:      %v\n", elapsed.Round(time.Millisecond))
+	if len(failures) > 0 {
+		sort.Slice(failures, func(i, k int) bool {
+			return failures[i].line < failures[k].line
+		})
+		fmt.Fprintln(os.Stderr, "Failed copies:")
+		for _, f := range failures {
+			fmt.Fprintf(os.Stderr, "  line %d: %s -> %s: %v\n", f.line, f.source, f.destination, f.err)
+		}
+		if left := int64(len(jobs)-len(failures)) - copied.Load() - skipped.Load(); *maxErrors > 0 && len(failures) >= *maxErrors && left > 0 {
+			return fmt.Errorf("too many errors, aborting: %d copies failed, %d of %d not attempted", len(failures), left, len(jobs))
+		}
+		return fmt.Errorf("%d of %d copies failed", len(failures), len(jobs))
+	}
+	return nil
+}
+
+// Fail early when the destination filesystems don't have an inode for each
+// new file, which would fail with ENOSPC despite having free space.
+func checkInodes(jobs []job) error {
+	need := make(map[uint64]int64)
+	dirs := make(map[uint64]string)
+	for _, j := range jobs {
+		if _, err := os.Lstat(j.destination); err == nil {
+			continue
+		}
+		var st unix.Stat_t
+		dir := filepath.Dir(j.destination)
+		if unix.Stat(dir, &st) != nil {
+			continue
+		}
+		dev := uint64(st.Dev)
+		need[dev]++
+		dirs[dev] = dir
+	}
+	for dev, n := range need {
+		free, err := freeInodes(dirs[dev])
+		if err == nil && n > free {
+			return fmt.Errorf("insufficient inodes in the filesystem of %s: need %d, have %d", dirs[dev], n, free)
+		}
+	}
+	return nil
+}
+
+// Get the number of files pcp may keep open while copying a list, from
+// -max-open-files or else the open files limit of the process
+func openFilesLimit() (int, error) {
+	if *maxOpenFiles > 0 {
+		return *maxOpenFiles, nil
+	}
+	var rlim unix.Rlimit
+	err := unix.Getrlimit(unix.RLIMIT_NOFILE, &rlim)
+	if err != nil {
+		return 0, err
+	}
+	if rlim.Cur > math.MaxInt32 {
+		return math.MaxInt32, nil
+	}
+	return int(rlim.Cur), nil
+}
+
+// Count the descriptors open in the process, from /dev/fd where the
+// system lists them all, or else only the standard streams. A few are
+// added for the runtime, which opens its own as it needs them.
+func openFiles() int {
+	const spare = 4
+	fds, err := os.ReadDir("/dev/fd")
+	// Reading the directory keeps it open, and it is listed too
+	if err != nil || len(fds) <= 4 {
+		return 3 + spare
+	}
+	return len(fds) - 1 + spare
+}
+
+// Read copy jobs from a list file.
+// Each line holds a source and a destination separated by a tab or spaces,
+// or only a source when a target directory is set.
+func readJobs(list string) ([]job, error) {
+	var r io.Reader = os.Stdin
+	if list != "-" {
+		f, err := os.Open(list)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var jobs []job
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if *targetDir != "" {
+			name := filepath.Base(line)
+			if *renamePattern != "" {
+				name = rename(*renamePattern, name, len(jobs)+1)
+			}
+			jobs = append(jobs, job{n, line, filepath.Join(*targetDir, name)})
+			continue
+		}
+		var fields []string
+		if strings.Contains(line, "\t") {
+			fields = strings.SplitN(line, "\t", 2)
+			fields[1] = strings.TrimSpace(fields[1])
+		} else {
+			fields = strings.Fields(line)
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: expected source and destination", list, n)
+		}
+		jobs = append(jobs, job{n, fields[0], fields[1]})
+	}
+	return jobs, scanner.Err()
+}
+
+// Expand a rename pattern for a file name.
+// {name} is the file name, {base} the name without extension,
+// {ext} the extension including the dot and {n} the file counter.
+func rename(pattern, name string, counter int) string {
+	ext := filepath.Ext(name)
+	return strings.NewReplacer(
+		"{name}", name,
+		"{base}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+		"{n}", strconv.Itoa(counter),
+	).Replace(pattern)
+}
@@ -0,0 +1,63 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestMaxOpenFiles(t *testing.T) {
+	if _, err := os.ReadDir("/dev/fd"); err != nil {
+		t.Skip("the system doesn't list the open descriptors:", err)
+	}
+	setFlag(t, "f", "true")
+	setFlag(t, "j", "16")
+	setFlag(t, "t", "16")
+	// Room for two copies next to the descriptors already open
+	limit := openFiles() + 4
+	setFlag(t, "max-open-files", strconv.Itoa(limit))
+	var lock sync.Mutex
+	var peak int
+	setMmap(t, func(fd int, offset int64, length, prot, flags int) ([]byte, error) {
+		lock.Lock()
+		fds, err := os.ReadDir("/dev/fd")
+		if err == nil && len(fds)-1 > peak {
+			peak = len(fds) - 1
+		}
+		lock.Unlock()
+		// Keep the files open long enough for the copies to overlap
+		time.Sleep(10 * time.Millisecond)
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	dir := t.TempDir()
+	var list strings.Builder
+	for i := 0; i < 16; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", i))
+		writeRandom(t, src, *streamBelow)
+		fmt.Fprintf(&list, "%s %s.copy\n", src, src)
+	}
+	listFile := filepath.Join(dir, "list")
+	if err := os.WriteFile(listFile, []byte(list.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := batchCopy(listFile); err != nil {
+		t.Fatal(err)
+	}
+	if peak > limit {
+		t.Errorf("%d files open at once, -max-open-files=%d", peak, limit)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+	"time"
+)
+
+// Measure copy throughput of each method with a range of thread counts
+func bench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	size := sizeFlag(1 << 30)
+	flags.Var(&size, "size", "`Size` of the test file.")
+	maxThreads := flags.Int("t", runtime.NumCPU(), "Maximum number of threads to test.")
+	flags.Var((*sizeFlag)(bufferSize), "buffer-size", "`Size` of the buffer of each thread of the pread method.")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage %s bench [-size=size] [-t=threads] directory", os.Args[0])
+	}
+	dir := flags.Arg(0)
+
+	source, err := benchFile(dir, int64(size))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(source)
+	destination := source + ".copy"
+	defer os.Remove(destination)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tTHREADS\tTIME\tMiB/s")
+	defer func() { *noMmap = false }()
+	for _, method := range []string{"mmap", "pread"} {
+		*noMmap = method == "pread"
+		for _, n := range benchThreads(*maxThreads) {
+			os.Remove(destination)
+			start := time.Now()
+			_, _, err = pcopy(source, destination, n)
+			if err != nil {
+				return err
+			}
+			elapsed := time.Since(start)
+			fmt.Fprintf(w, "%s\t%d\t%v\t%.1f\n", method, n, elapsed.Round(time.Millisecond),
+				float64(size)/(1<<20)/elapsed.Seconds())
+		}
+	}
+	return w.Flush()
+}
+
+// Create a test file filled with random data
+func benchFile(dir string, size int64) (string, error) {
+	f, err := os.CreateTemp(dir, "pcp-bench-")
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 1<<20)
+	for written := int64(0); written < size; written += int64(len(buf)) {
+		if size-written < int64(len(buf)) {
+			buf = buf[:size-written]
+		}
+		if _, err = rand.Read(buf); err != nil {
+			break
+		}
+		if _, err = f.Write(buf); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return filepath.Clean(f.Name()), nil
+}
+
+// Thread counts to test, powers of two up to the maximum
+func benchThreads(limit int) []int {
+	var counts []int
+	for n := 1; n < limit; n *= 2 {
+		counts = append(counts, n)
+	}
+	return append(counts, limit)
+}
@@ -0,0 +1,18 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Restore the birth time of the source. FreeBSD has no call to set it,
+// but moves it back when a file gets a modification time older than its
+// birth time, so the birth time is set as the modification time first and
+// the real times are set after it.
+func setBirthTime(destination string, st *unix.Stat_t) error {
+	return unix.UtimesNanoAt(unix.AT_FDCWD, destination, []unix.Timespec{st.Atim, st.Btim}, 0)
+}
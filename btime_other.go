@@ -0,0 +1,18 @@
+//go:build !freebsd
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Linux can read but not set birth times, and setting them on macOS needs
+// setattrlist, which golang.org/x/sys doesn't provide, so they are skipped
+func setBirthTime(destination string, st *unix.Stat_t) error {
+	return nil
+}
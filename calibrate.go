@@ -0,0 +1,53 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "time"
+
+// Set when the thread count was not given with -t and may be calibrated
+var autoThreads bool
+
+// Smallest file worth calibrating the thread count for
+const calibrateMin = 4 << 30
+
+// Largest part of a file copied by the calibration rounds
+const calibrateShare = 50
+
+// Pick the thread count with the best throughput for a large copy, by
+// copying the start of the source in rounds of doubling parallelism until
+// more threads stop helping. The calibration copies real data, so nothing
+// is copied twice. Returns the thread count and the offset copied so far.
+func (t *transfer) calibrate(size, dstOffset int64, threads int) (int, int64) {
+	piece := align(*minChunk)
+	if piece < pageSize {
+		piece = pageSize
+	}
+	budget := size / calibrateShare
+	best, bestRate := 1, 0.0
+	var offset int64
+	for n := 1; n <= threads && offset+int64(n)*piece <= budget; n *= 2 {
+		start := time.Now()
+		for i := 0; i < n; i++ {
+			t.wg.Add(1)
+			off := offset + int64(i)*piece
+			go t.mcopy(off, dstOffset+off, piece)
+		}
+		t.wg.Wait()
+		offset += int64(n) * piece
+		if t.failed.Load() {
+			break
+		}
+		rate := float64(int64(n)*piece) / time.Since(start).Seconds()
+		// Stop when doubling the threads gains less than a tenth
+		if rate < bestRate*1.1 {
+			break
+		}
+		best, bestRate = n, rate
+	}
+	return best, offset
+}
@@ -0,0 +1,94 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Record of the copies of a list that completed, so an interrupted list
+// can be resumed. Each line holds the source and the destination of a
+// completed copy separated by a tab.
+type checkpoint struct {
+	f      *os.File
+	lock   sync.Mutex
+	synced time.Time
+	done   map[string]bool
+}
+
+// Open a checkpoint file. With resume the copies it records are loaded,
+// otherwise it is started over.
+func openCheckpoint(path string, resume bool) (*checkpoint, error) {
+	c := &checkpoint{done: make(map[string]bool), synced: time.Now()}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	if resume {
+		f, err := os.Open(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			scanner := bufio.NewScanner(f)
+			for scanner.Scan() {
+				c.done[scanner.Text()] = true
+			}
+			err = scanner.Err()
+			f.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	c.f = f
+	return c, nil
+}
+
+func checkpointKey(j job) string {
+	return j.source + "\t" + j.destination
+}
+
+// Check if a copy completed in a previous run
+func (c *checkpoint) completed(j job) bool {
+	return c.done[checkpointKey(j)]
+}
+
+// Record a completed copy. Records are written right away and synced to
+// disk every -checkpoint-interval.
+func (c *checkpoint) record(j job) error {
+	key := checkpointKey(j)
+	if strings.ContainsAny(key, "\n") {
+		return fmt.Errorf("can't checkpoint file names with newlines")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := fmt.Fprintln(c.f, key)
+	if err == nil && time.Since(c.synced) >= *checkpointInterval {
+		err = c.f.Sync()
+		c.synced = time.Now()
+	}
+	return err
+}
+
+// Close the checkpoint, removing it when the whole list was copied
+func (c *checkpoint) close(complete bool) error {
+	err := c.f.Close()
+	if err == nil && complete {
+		err = os.Remove(c.f.Name())
+	}
+	return err
+}
@@ -0,0 +1,192 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Block checksum sidecar format. After the two header lines each line holds
+// the offset of a block and the hex digest of its data, with the -hash
+// algorithm named in the second line:
+//
+//	# pcp block checksums
+//	# sha256 block 1048576 size 3145728
+//	0 <sha256 of bytes 0-1048575>
+//	1048576 <sha256 of bytes 1048576-2097151>
+//	2097152 <sha256 of bytes 2097152-3145727>
+const checksumsHeader = "# pcp block checksums"
+
+// Hash the blocks of a file in parallel
+func fileChecksums(f *os.File, size, block int64, algo hashAlgo, threads int) ([]string, error) {
+	sums := make([]string, (size+block-1)/block)
+	var wg sync.WaitGroup
+	errs := make(chan error, threads)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf := make([]byte, block)
+			h := algo.new()
+			for b := i; b < len(sums); b += threads {
+				off := int64(b) * block
+				n, err := f.ReadAt(buf, off)
+				if err != nil && !(errors.Is(err, io.EOF) && off+int64(n) == size) {
+					errs <- &copyError{"checksum", off, block, err}
+					return
+				}
+				h.Reset()
+				h.Write(buf[:n])
+				sums[b] = hex.EncodeToString(h.Sum(nil))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return sums, nil
+}
+
+// Write the block checksums sidecar of a copied destination. The data is
+// read back right after the copy, while it is still in the page cache, so
+// the checksums describe what actually landed in the destination.
+func writeChecksums(destination, sidecar string, threads int) error {
+	algo, err := lookupHash(*hashName)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(destination)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	stat, size, err := sourceSize(f)
+	if err != nil {
+		return err
+	}
+	if !stat.Mode().IsRegular() && !isBlockDevice(stat) {
+		return fmt.Errorf("can't read back %s for block checksums", destination)
+	}
+	sums, err := fileChecksums(f, size, *checksumBlock, algo, threads)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(sidecar)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintln(w, checksumsHeader)
+	fmt.Fprintf(w, "# %s block %d size %d\n", algo.name, *checksumBlock, size)
+	for i, sum := range sums {
+		fmt.Fprintln(w, int64(i)**checksumBlock, sum)
+	}
+	err = w.Flush()
+	if err == nil && *syncData {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Read a block checksums sidecar, with the algorithm it was written with
+func readChecksums(sidecar string) (algo hashAlgo, block, size int64, sums []string, err error) {
+	f, err := os.Open(sidecar)
+	if err != nil {
+		return algo, 0, 0, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() || scanner.Text() != checksumsHeader {
+		return algo, 0, 0, nil, fmt.Errorf("%s is not a pcp block checksums file", sidecar)
+	}
+	if !scanner.Scan() {
+		return algo, 0, 0, nil, fmt.Errorf("%s: missing block size", sidecar)
+	}
+	var name string
+	_, err = fmt.Sscanf(scanner.Text(), "# %s block %d size %d", &name, &block, &size)
+	if err != nil || block <= 0 || size < 0 {
+		return algo, 0, 0, nil, fmt.Errorf("%s: malformed header %q", sidecar, scanner.Text())
+	}
+	algo, err = lookupHash(name)
+	if err != nil {
+		return algo, 0, 0, nil, fmt.Errorf("%s: %w", sidecar, err)
+	}
+	for line := 3; scanner.Scan(); line++ {
+		offset, sum, ok := strings.Cut(scanner.Text(), " ")
+		off, err := strconv.ParseInt(offset, 10, 64)
+		if !ok || err != nil || off != int64(len(sums))*block || len(sum) != 2*algo.size {
+			return algo, 0, 0, nil, fmt.Errorf("%s:%d: malformed checksum line", sidecar, line)
+		}
+		sums = append(sums, sum)
+	}
+	if err = scanner.Err(); err != nil {
+		return algo, 0, 0, nil, err
+	}
+	if int64(len(sums)) != (size+block-1)/block {
+		return algo, 0, 0, nil, fmt.Errorf("%s: %d checksums for %d bytes", sidecar, len(sums), size)
+	}
+	return algo, block, size, sums, nil
+}
+
+// Verify a file against its block checksums sidecar, reporting each
+// block that no longer matches
+func scrubFile(path, sidecar string, threads int) error {
+	algo, block, size, want, err := readChecksums(sidecar)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, fileSize, err := sourceSize(f)
+	if err != nil {
+		return err
+	}
+	if fileSize != size {
+		return fmt.Errorf("%s: size %d, expected %d", path, fileSize, size)
+	}
+	got, err := fileChecksums(f, size, block, algo, threads)
+	if err != nil {
+		return err
+	}
+	var bad int
+	for i := range want {
+		if got[i] != want[i] {
+			// The last block ends with the file
+			offset := int64(i) * block
+			length := block
+			if size-offset < length {
+				length = size - offset
+			}
+			log.Printf("%s: block at offset %d, %d bytes, is corrupted", path, offset, length)
+			bad++
+		}
+	}
+	if bad > 0 {
+		return fmt.Errorf("%s: %d of %d blocks failed the scrub", path, bad, len(want))
+	}
+	fmt.Printf("%s: %d blocks verified\n", path, len(want))
+	return nil
+}
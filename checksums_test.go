@@ -0,0 +1,51 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScrubLastBlock(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "checksum-block", "64K")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 300000)
+	dst := filepath.Join(dir, "dst")
+	sidecar := filepath.Join(dir, "dst.sums")
+	setFlag(t, "block-checksums", sidecar)
+	if _, err := copyFile(src, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("rot"), 299990)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	if err = scrubFile(dst, sidecar, 2); err == nil {
+		t.Fatal("scrubbed a corrupted file")
+	}
+	// The last block holds the 37856 bytes after the four full ones
+	if want := "block at offset 262144, 37856 bytes, is corrupted"; !strings.Contains(out.String(), want) {
+		t.Errorf("got %q, want %q", out.String(), want)
+	}
+}
@@ -0,0 +1,21 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Make the destination share the extents of the source with the FICLONE
+// ioctl. Both must be on the same filesystem, and it must support reflinks,
+// like Btrfs and XFS, otherwise it fails with EXDEV or EOPNOTSUPP.
+func cloneFile(src, dst *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,60 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+)
+
+// Copy a file through a gzip compressor or decompressor.
+// The output size is not known in advance, so data is streamed
+// instead of mapped in memory.
+func zcopy(source, destination string) (int64, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	stat, err := src.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !stat.Mode().IsRegular() && !isBlockDevice(stat) {
+		return 0, errors.New("pcp only works on regular files and block devices")
+	}
+	progress.total.Add(stat.Size())
+
+	dst, err := openTarget(destination, os.O_WRONLY|os.O_TRUNC, stat.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if *decompress {
+		var zr *gzip.Reader
+		zr, err = gzip.NewReader(progressReader{src})
+		if err == nil {
+			n, err = io.Copy(dst, zr)
+		}
+	} else {
+		zw := gzip.NewWriter(dst)
+		n, err = io.Copy(zw, progressReader{src})
+		if cerr := zw.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && *keepContext {
+		err = copyContext(src, dst.File)
+	}
+	if err == nil && *syncData {
+		err = dst.Sync()
+	}
+	return n, dst.finish(err)
+}
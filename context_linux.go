@@ -0,0 +1,47 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const contextSupported = true
+
+// Extended attribute holding the SELinux security context of a file
+const selinuxXattr = "security.selinux"
+
+// Copy the SELinux security context of the source to the destination.
+// Sources without a context are skipped, and without the privilege to
+// relabel files the destination keeps its default context.
+func copyContext(src, dst *os.File) error {
+	size, err := unix.Fgetxattr(int(src.Fd()), selinuxXattr, nil)
+	if err == unix.ENODATA || err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "getxattr", Path: src.Name(), Err: err}
+	}
+	value := make([]byte, size)
+	size, err = unix.Fgetxattr(int(src.Fd()), selinuxXattr, value)
+	if err != nil {
+		return &os.PathError{Op: "getxattr", Path: src.Name(), Err: err}
+	}
+	err = unix.Fsetxattr(int(dst.Fd()), selinuxXattr, value[:size], 0)
+	if err == unix.EPERM || err == unix.EACCES {
+		log.Printf("%s: not permitted to set the SELinux context, keeping the default context", dst.Name())
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: dst.Name(), Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "os"
+
+const contextSupported = false
+
+// SELinux contexts are Linux only
+func copyContext(src, dst *os.File) error {
+	return nil
+}
@@ -0,0 +1,151 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+	"sync"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// CRC32C of a range of the source
+type crcPart struct {
+	length int64
+	crc    uint32
+}
+
+// CRC32C of the source of a -crc copy. Threads add the CRC of each range
+// they copy, in any order, and ranges are combined in offset order once
+// the data before them is in, so crc always covers the first end bytes.
+var copyCRC struct {
+	lock    sync.Mutex
+	crc     uint32
+	end     int64
+	pending map[int64]crcPart
+}
+
+func addCRC(offset, length int64, crc uint32) {
+	copyCRC.lock.Lock()
+	defer copyCRC.lock.Unlock()
+	if copyCRC.pending == nil {
+		copyCRC.pending = make(map[int64]crcPart)
+	}
+	copyCRC.pending[offset] = crcPart{length, crc}
+	for p, ok := copyCRC.pending[copyCRC.end]; ok; p, ok = copyCRC.pending[copyCRC.end] {
+		delete(copyCRC.pending, copyCRC.end)
+		copyCRC.crc = crc32cCombine(copyCRC.crc, p.crc, p.length)
+		copyCRC.end += p.length
+	}
+}
+
+// CRC32C of the data copied so far and its length
+func prefixCRC() (uint32, int64) {
+	copyCRC.lock.Lock()
+	defer copyCRC.lock.Unlock()
+	return copyCRC.crc, copyCRC.end
+}
+
+// Check the CRC32C of a completed copy against -expect-crc and print it
+func checkCRC(source string) error {
+	copyCRC.lock.Lock()
+	crc, missing := copyCRC.crc, len(copyCRC.pending) > 0
+	copyCRC.lock.Unlock()
+	if missing {
+		return fmt.Errorf("%s: crc32c is missing data at offset %d", source, copyCRC.end)
+	}
+	if *expectCRC != "" {
+		want, err := strconv.ParseUint(*expectCRC, 16, 32)
+		if err != nil {
+			return fmt.Errorf("invalid -expect-crc %q", *expectCRC)
+		}
+		if uint32(want) != crc {
+			return fmt.Errorf("%s: crc32c mismatch, expected %08x, got %08x", source, want, crc)
+		}
+	}
+	fmt.Printf("%s: crc32c %08x\n", source, crc)
+	return nil
+}
+
+// Reader that adds the CRC32C of a streamed range of the source, starting
+// at offset, in progressStep parts as it is read
+type crcReader struct {
+	io.Reader
+	offset, length int64
+	crc            uint32
+}
+
+func (r *crcReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.crc = crc32.Update(r.crc, castagnoli, p[:n])
+	r.length += int64(n)
+	if r.length >= progressStep || (err != nil && r.length > 0) {
+		addCRC(r.offset, r.length, r.crc)
+		r.offset += r.length
+		r.length, r.crc = 0, 0
+	}
+	return n, err
+}
+
+// Multiply a vector by a matrix over GF(2)
+func gf2Times(mat *[32]uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i, vec = i+1, vec>>1 {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+	}
+	return sum
+}
+
+func gf2Square(square, mat *[32]uint32) {
+	for n := range square {
+		square[n] = gf2Times(mat, mat[n])
+	}
+}
+
+// Get the CRC32C of two concatenated ranges from their CRCs and the length
+// of the second one, by applying len2 zero bytes to crc1 as in zlib
+func crc32cCombine(crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	// Operator for one zero bit
+	var even, odd [32]uint32
+	odd[0] = crc32.Castagnoli
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2Square(&even, &odd) // two zero bits
+	gf2Square(&odd, &even) // four zero bits
+	// Apply len2 zero bytes, squaring the operator for each bit of len2
+	for {
+		gf2Square(&even, &odd)
+		if len2&1 != 0 {
+			crc1 = gf2Times(&even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2Square(&odd, &even)
+		if len2&1 != 0 {
+			crc1 = gf2Times(&odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
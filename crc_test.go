@@ -0,0 +1,79 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// Forget the CRC of the previous copy
+func resetCRC(t *testing.T) {
+	copyCRC.crc, copyCRC.end, copyCRC.pending = 0, 0, nil
+	t.Cleanup(func() { copyCRC.crc, copyCRC.end, copyCRC.pending = 0, 0, nil })
+}
+
+func TestCRC32CCombine(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+	want := crc32.Checksum(data, castagnoli)
+	for _, split := range []int{0, 1, 7, 4096, 5000, 9999, 10000} {
+		crc1 := crc32.Checksum(data[:split], castagnoli)
+		crc2 := crc32.Checksum(data[split:], castagnoli)
+		if got := crc32cCombine(crc1, crc2, int64(len(data)-split)); got != want {
+			t.Errorf("split at %d: got %08x, want %08x", split, got, want)
+		}
+	}
+}
+
+func TestAddCRCOutOfOrder(t *testing.T) {
+	resetCRC(t)
+	data := make([]byte, 1<<16)
+	rand.New(rand.NewSource(2)).Read(data)
+	// Parts finish in any order, the prefix only grows when the gap is filled
+	parts := []struct{ offset, length int64 }{{40000, 25536}, {0, 1000}, {1000, 39000}}
+	ends := []int64{0, 1000, 1 << 16}
+	for i, p := range parts {
+		addCRC(p.offset, p.length, crc32.Checksum(data[p.offset:p.offset+p.length], castagnoli))
+		crc, end := prefixCRC()
+		if end != ends[i] {
+			t.Fatalf("after part %d: prefix ends at %d, want %d", i, end, ends[i])
+		}
+		if want := crc32.Checksum(data[:end], castagnoli); crc != want {
+			t.Fatalf("after part %d: got %08x, want %08x", i, crc, want)
+		}
+	}
+}
+
+func TestCopyCRC(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "crc", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeRandom(t, src, 3<<20+11)
+	want := crc32.Checksum(data, castagnoli)
+	for _, method := range []string{"mmap", "pread"} {
+		resetCRC(t)
+		setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+		if _, err := copyFile(src, filepath.Join(dir, method), 4); err != nil {
+			t.Fatal(err)
+		}
+		crc, end := prefixCRC()
+		if end != int64(len(data)) || crc != want {
+			t.Errorf("%s: got %08x of %d bytes, want %08x of %d", method, crc, end, want, len(data))
+		}
+		setFlag(t, "expect-crc", strconv.FormatUint(uint64(want^1), 16))
+		if err := checkCRC(src); err == nil {
+			t.Errorf("%s: -expect-crc accepted a wrong crc", method)
+		}
+	}
+}
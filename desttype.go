@@ -0,0 +1,68 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check the type of an existing destination before copying to it. Regular
+// files and block devices are written to, named pipes get a stream, and
+// symlinks are followed unless -no-dereference-dest replaces them. Other
+// types are refused, except that -force-type-change removes an empty
+// directory or a socket to create the file in its place. Character devices
+// are always refused.
+func checkDestType(destination string) error {
+	// The first link to check, or replace, is the destination itself
+	if !*noDerefDest {
+		if resolved, err := filepath.EvalSymlinks(destination); err == nil {
+			destination = resolved
+		}
+	}
+	info, err := os.Lstat(destination)
+	if err != nil {
+		// Missing destinations, and the targets of dangling links, are created
+		return nil
+	}
+	var kind string
+	switch mode := info.Mode(); {
+	case mode.IsRegular(), mode&os.ModeSymlink != 0, isBlockDevice(info), isNamedPipe(info):
+		return nil
+	case mode&os.ModeCharDevice != 0:
+		return fmt.Errorf("destination %s is a character device, pcp only writes to files, block devices and pipes", destination)
+	case mode.IsDir():
+		kind = "a directory"
+	case mode&os.ModeSocket != 0:
+		kind = "a socket"
+	default:
+		return fmt.Errorf("destination %s is not a file, pcp only writes to files, block devices and pipes", destination)
+	}
+	if !*forceType {
+		return fmt.Errorf("destination %s is %s, use -force-type-change to replace it with a file", destination, kind)
+	}
+	if *noClobber {
+		return fmt.Errorf("%s: %w", destination, errNotOverwritten)
+	}
+	if *appendMode || *delta {
+		return fmt.Errorf("destination %s is %s, it has no data to append to or compare with", destination, kind)
+	}
+	if *dryRun {
+		return nil
+	}
+	// Only empty directories are removed, nothing in them is lost
+	err = os.Remove(destination)
+	if errors.Is(err, unix.ENOTEMPTY) || errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("destination %s is a directory that is not empty, it is not replaced", destination)
+	}
+	return err
+}
@@ -0,0 +1,99 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// Check that a copy would succeed without writing anything: the source
+// is readable, the destination can be opened for writing and there is
+// space for the data in its filesystem. The result holds the plan of the copy.
+func checkCopy(source, destination string, threads int) (*result, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	stat, size, err := sourceSize(src)
+	if err != nil {
+		return nil, err
+	}
+	if manifest != nil {
+		err = verifySource(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// With -D missing parents would be created in the nearest existing one
+	dir := filepath.Dir(destination)
+	for *parents {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("destination directory %s does not exist", dir)
+	}
+
+	need := dataSize(src, stat, size)
+	// The output size of compression is not known in advance
+	if *compress != "" || *decompress || *metadataOnly {
+		need = 0
+	}
+	info, err := os.Stat(destination)
+	switch {
+	case err == nil && isNamedPipe(info):
+		// Opening a pipe would wait for a reader
+		need = 0
+	case err == nil && (info.IsDir() || info.Mode()&os.ModeSocket != 0):
+		// Replaced by -force-type-change, the file is created in its place
+		err = unix.Access(filepath.Dir(destination), unix.W_OK|unix.X_OK)
+		if err != nil {
+			return nil, &os.PathError{Op: "access", Path: filepath.Dir(destination), Err: err}
+		}
+	case err == nil:
+		if *noClobber {
+			return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+		}
+		f, err := os.OpenFile(destination, os.O_WRONLY, 0)
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		if isBlockDevice(info) {
+			need = 0
+		} else if !*appendMode {
+			need -= info.Size()
+		}
+	case os.IsNotExist(err):
+		err = unix.Access(dir, unix.W_OK|unix.X_OK)
+		if err != nil {
+			return nil, &os.PathError{Op: "access", Path: dir, Err: err}
+		}
+	default:
+		return nil, err
+	}
+	if need > 0 && !*cowOnly {
+		avail, err := freeSpaceFunc(dir)
+		if err == nil && need > avail {
+			return nil, fmt.Errorf("insufficient space: need %d bytes, have %d", need, avail)
+		}
+	}
+	p, err := makePlan(source, destination, threads)
+	if err != nil {
+		return nil, err
+	}
+	return &result{Source: source, Destination: destination, BytesCopied: size, Plan: p}, nil
+}
@@ -0,0 +1,44 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"hash/crc32"
+)
+
+// A checksum algorithm selected with -hash
+type hashAlgo struct {
+	name string
+	size int // bytes of a digest, twice as many hex digits
+	new  func() hash.Hash
+}
+
+// Algorithms of -hash, all in the standard library. Adding one only takes
+// an entry here.
+var hashAlgos = map[string]hashAlgo{
+	"crc32c": {"crc32c", crc32.Size, func() hash.Hash { return crc32.New(castagnoli) }},
+	"md5":    {"md5", md5.Size, md5.New},
+	"sha1":   {"sha1", sha1.Size, sha1.New},
+	"sha256": {"sha256", sha256.Size, sha256.New},
+	"sha512": {"sha512", sha512.Size, sha512.New},
+}
+
+// Get a checksum algorithm by name
+func lookupHash(name string) (hashAlgo, error) {
+	h, ok := hashAlgos[name]
+	if !ok {
+		return hashAlgo{}, fmt.Errorf("unsupported hash %s, use crc32c, md5, sha1, sha256 or sha512", name)
+	}
+	return h, nil
+}
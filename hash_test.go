@@ -0,0 +1,115 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupHash(t *testing.T) {
+	for name, want := range map[string]string{
+		"crc32c": "e3069283",
+		"md5":    "25f9e794323b453885f5181f1b624d0b",
+		"sha256": "15e2b0d3c33891ebb0f1ef609ec419420c20e320ce94c65fbc8c3312448eb225",
+	} {
+		algo, err := lookupHash(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := algo.new()
+		h.Write([]byte("123456789"))
+		if got := hex.EncodeToString(h.Sum(nil)); got != want || len(got) != 2*algo.size {
+			t.Errorf("%s: got %s, want %s", name, got, want)
+		}
+	}
+	if _, err := lookupHash("xxh64"); err == nil {
+		t.Error("found an unsupported hash")
+	}
+}
+
+func TestManifestHash(t *testing.T) {
+	setFlag(t, "hash", "crc32c")
+	t.Cleanup(func() { manifest = nil })
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := os.WriteFile(src, []byte("123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sums := filepath.Join(dir, "CRC32CSUMS")
+	if err := os.WriteFile(sums, []byte("e3069283  src\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var err error
+	manifest, err = loadManifest(sums)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = verifySource(src); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(src, []byte("12345678!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = verifySource(src); err == nil {
+		t.Fatal("verified a changed source")
+	}
+	// Digests of another algorithm are malformed lines
+	setFlag(t, "hash", "sha256")
+	if _, err = loadManifest(sums); err == nil {
+		t.Fatal("loaded crc32c digests as sha256")
+	}
+}
+
+func TestBlockChecksumsHash(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "hash", "crc32c")
+	setFlag(t, "checksum-block", "64K")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 300000)
+	dst := filepath.Join(dir, "dst")
+	sidecar := filepath.Join(dir, "dst.sums")
+	setFlag(t, "block-checksums", sidecar)
+	if _, err := copyFile(src, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	scanner.Scan()
+	f.Close()
+	if got, want := scanner.Text(), fmt.Sprintf("# crc32c block %d size 300000", 64<<10); got != want {
+		t.Errorf("header %q, want %q", got, want)
+	}
+
+	// Scrubs use the algorithm of the sidecar
+	setFlag(t, "hash", "sha256")
+	if err = scrubFile(dst, sidecar, 2); err != nil {
+		t.Fatal(err)
+	}
+	g, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = g.WriteAt([]byte("rot"), 200000)
+	g.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = scrubFile(dst, sidecar, 2); err == nil {
+		t.Fatal("scrubbed a corrupted file")
+	}
+}
@@ -0,0 +1,53 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+)
+
+// Run the -on-complete or the -on-error command of a copy that ended with
+// err, through the shell with the copy described in its environment. A
+// failing hook is logged, and only fails a successful copy with -hook-errors.
+func runHook(source, destination string, res *result, err error) error {
+	if *dryRun || errors.Is(err, errNotOverwritten) || errors.Is(err, errUpToDate) {
+		return err
+	}
+	command := *onComplete
+	if err != nil {
+		command = *onError
+	}
+	if command == "" {
+		return err
+	}
+	var n int64
+	if res != nil {
+		n = res.BytesCopied
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), "PCP_SRC="+source, "PCP_DST="+destination, "PCP_BYTES="+strconv.FormatInt(n, 10))
+	if err != nil {
+		cmd.Env = append(cmd.Env, "PCP_ERROR="+err.Error())
+	}
+	herr := cmd.Run()
+	if herr == nil {
+		return err
+	}
+	herr = fmt.Errorf("%s: hook %q: %w", destination, command, herr)
+	if err == nil && *hookErrors {
+		return herr
+	}
+	log.Println(herr)
+	return err
+}
@@ -0,0 +1,79 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extent layouts can be read and reproduced, for -preserve-extents
+const layoutSupported = true
+
+// Allocate the destination extent by extent like the source, as reported by
+// FIEMAP, preallocated extents included, instead of leaving the allocation
+// to the copy. Each extent is allocated with its own fallocate in file
+// order, so the filesystem gets the chance to place them the same way.
+func allocateLike(src, dst *os.File, size int64) error {
+	extents, err := allocatedExtents(src, size)
+	if err != nil {
+		return err
+	}
+	for _, e := range extents {
+		err = unix.Fallocate(int(dst.Fd()), unix.FALLOC_FL_KEEP_SIZE, e.offset, e.length)
+		if err != nil {
+			return &os.PathError{Op: "fallocate", Path: dst.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// Reserve the blocks of ranges of a file, moved by offset, before they are
+// written. With keepSize the reported size of the file doesn't change.
+func preallocate(f *os.File, ranges []extent, offset int64, keepSize bool) error {
+	var mode uint32
+	if keepSize {
+		mode = unix.FALLOC_FL_KEEP_SIZE
+	}
+	for _, r := range ranges {
+		err := unix.Fallocate(int(f.Fd()), mode, offset+r.offset, r.length)
+		if err != nil {
+			return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+		}
+	}
+	return nil
+}
+
+// Deallocate a range of a file, which then reads as zeros, keeping its size
+func punchHole(f *os.File, offset, length int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_PUNCH_HOLE|unix.FALLOC_FL_KEEP_SIZE, offset, length)
+	if err != nil {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: err}
+	}
+	return nil
+}
+
+// Read every allocated extent of a file with FIEMAP, unwritten ones too,
+// without merging adjacent extents
+func allocatedExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	err := fiemapEach(f, size, func(e *fiemapExtent) {
+		if int64(e.logical) < size {
+			length := int64(e.length)
+			if int64(e.logical)+length > size {
+				length = size - int64(e.logical)
+			}
+			extents = append(extents, extent{int64(e.logical), length})
+		}
+	})
+	if err != nil {
+		return nil, &os.PathError{Op: "fiemap", Path: f.Name(), Err: err}
+	}
+	return extents, nil
+}
@@ -0,0 +1,104 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Allocated extents of the file at path, unwritten ones too
+func fileAllocation(t *testing.T, path string, size int64) []extent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	extents, err := allocatedExtents(f, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return extents
+}
+
+func TestPreserveExtents(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "preserve-extents", "true")
+	// Without -sparse the copy fills the holes
+	setFlag(t, "sparse", "always")
+	dir := t.TempDir()
+	const block = 64 << 10
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 8*block, []extent{{0, block}, {5 * block, block}})
+	// A preallocated extent holds no data but is part of the layout
+	f, err := os.OpenFile(src, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 2*block, 2*block)
+	f.Close()
+	if err != nil {
+		t.Skipf("can't preallocate %s: %v", src, err)
+	}
+	want := fileAllocation(t, src, 8*block)
+
+	dst := filepath.Join(dir, "dst")
+	writeRandom(t, dst, 8*block)
+	if _, err := copyFile(src, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+	var got []extent
+	for _, e := range fileAllocation(t, dst, 8*block) {
+		got = addExtent(got, e.offset, e.length, 8*block)
+	}
+	var merged []extent
+	for _, e := range want {
+		merged = addExtent(merged, e.offset, e.length, 8*block)
+	}
+	if !reflect.DeepEqual(got, merged) {
+		t.Errorf("destination allocated %v, source %v", got, merged)
+	}
+}
+
+func TestPreallocate(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sparse", "always")
+	dir := t.TempDir()
+	const block = 64 << 10
+	extents := []extent{{block, block}, {4 * block, 2 * block}}
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 8*block, extents)
+	for _, tc := range []struct {
+		mode string
+		want []extent
+	}{
+		// Sparse copies keep their holes only with keep-size
+		{"full", []extent{{0, 8 * block}}},
+		{"keep-size", extents},
+	} {
+		setFlag(t, "preallocate-mode", tc.mode)
+		dst := filepath.Join(dir, tc.mode)
+		if _, err := copyFile(src, dst, 2); err != nil {
+			t.Fatalf("%s: %v", tc.mode, err)
+		}
+		assertData(t, dst, data)
+		var got []extent
+		for _, e := range fileAllocation(t, dst, 8*block) {
+			got = addExtent(got, e.offset, e.length, 8*block)
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: destination allocated %v, want %v", tc.mode, got, tc.want)
+		}
+	}
+}
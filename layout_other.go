@@ -0,0 +1,33 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const layoutSupported = false
+
+// Extent layouts are Linux only
+func allocateLike(src, dst *os.File, size int64) error {
+	return unix.ENOSYS
+}
+
+// Preallocation is Linux only
+func preallocate(f *os.File, ranges []extent, offset int64, keepSize bool) error {
+	return &os.PathError{Op: "fallocate", Path: f.Name(), Err: unix.ENOSYS}
+}
+
+// Punching holes is Linux only
+func punchHole(f *os.File, offset, length int64) error {
+	return &os.PathError{Op: "fallocate", Path: f.Name(), Err: unix.ENOSYS}
+}
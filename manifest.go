@@ -0,0 +1,103 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Source checksums loaded from -verify-source-manifest, keyed by absolute path
+var manifest map[string]string
+
+// Parse a sha256sum style checksum file with digests of the -hash
+// algorithm. Relative names are resolved against the directory of the
+// manifest.
+func loadManifest(path string) (map[string]string, error) {
+	algo, err := lookupHash(*hashName)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	sums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		// Lines are "<hash>  <name>", or "<hash> *<name>" for binary mode
+		sum, name, ok := strings.Cut(text, " ")
+		name = strings.TrimPrefix(strings.TrimPrefix(name, " "), "*")
+		if !ok || name == "" || len(sum) != 2*algo.size {
+			return nil, fmt.Errorf("%s:%d: malformed checksum line", path, line)
+		}
+		if _, err := hex.DecodeString(sum); err != nil {
+			return nil, fmt.Errorf("%s:%d: malformed checksum line", path, line)
+		}
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		sums[filepath.Clean(name)] = strings.ToLower(sum)
+	}
+	return sums, scanner.Err()
+}
+
+// Check a source against its manifest checksum before it is copied
+func verifySource(source string) error {
+	path, err := filepath.Abs(source)
+	if err != nil {
+		return err
+	}
+	want, ok := manifest[path]
+	if !ok {
+		if *strictManifest {
+			return fmt.Errorf("%s is not listed in %s", source, *verifyManifest)
+		}
+		log.Printf("%s is not listed in %s, copying unverified", source, *verifyManifest)
+		return nil
+	}
+
+	algo, err := lookupHash(*hashName)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Chunks hashed in parallel would not give the standard digest,
+	// so the whole file is fed to one hash in offset order.
+	h := algo.new()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("%s: %s mismatch, expected %s, got %s", source, algo.name, want, got)
+	}
+	return nil
+}
@@ -0,0 +1,16 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Prefault mapped pages
+const mapPopulate = unix.MAP_POPULATE
+
+// Back mappings with transparent huge pages
+const madvHugepage = unix.MADV_HUGEPAGE
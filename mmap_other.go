@@ -0,0 +1,16 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+// MAP_POPULATE is Linux only
+const mapPopulate = 0
+
+// MADV_HUGEPAGE is Linux only
+const madvHugepage = 0
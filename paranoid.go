@@ -0,0 +1,65 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+// Size of the blocks compared by -paranoid-read
+const rereadBlock = 1 << 20
+
+// Unstable reads of the source, a sign of failing media
+var errUnstableRead = errors.New("source data changed between two reads, the media may be failing")
+
+// Read the size bytes of the source a second time, after dropping them from
+// the page cache so they come from the media again, and compare them with
+// the copy at dstOffset in dst, which holds the first read.
+func rereadSource(src, dst *os.File, size, dstOffset int64, threads int) error {
+	// Best effort, the second read may come from memory where it fails
+	dropCache(src, 0, size)
+	blocks := (size + rereadBlock - 1) / rereadBlock
+	var wg sync.WaitGroup
+	errs := make(chan error, threads)
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			first := make([]byte, rereadBlock)
+			second := make([]byte, rereadBlock)
+			for b := int64(i); b < blocks; b += int64(threads) {
+				off := b * rereadBlock
+				n := size - off
+				if n > rereadBlock {
+					n = rereadBlock
+				}
+				_, err := src.ReadAt(second[:n], off)
+				if err == nil {
+					_, err = dst.ReadAt(first[:n], dstOffset+off)
+				}
+				if err == nil && !bytes.Equal(first[:n], second[:n]) {
+					err = errUnstableRead
+				}
+				if errors.Is(err, io.EOF) {
+					err = io.ErrUnexpectedEOF
+				}
+				if err != nil {
+					errs <- &copyError{"reread", off, n, err}
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
@@ -15,163 +15,1150 @@
 package main
 
 import (
+	"bytes"
 	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
 
 var (
-	force   = flag.Bool("f", false, "Overwrite destination file if it exists.")
-	fsync   = flag.Bool("s", false, "Sync file to disk after done copying data.")
-	threads = flag.Int("t", 0, "Specifies the number of threads used to copy data simultaneously.")
+	force          = flag.Bool("f", false, "Overwrite destination file if it exists.")
+	noClobber      = flag.Bool("n", false, "Never overwrite an existing destination file.")
+	blockChecksums = flag.String("block-checksums", "", "Write the checksums of the destination blocks to a sidecar `file` for -scrub.")
+	checksumBlock  = flagSize("checksum-block", 1<<20, "`size` of the blocks of -block-checksums.")
+	hashName       = flag.String("hash", "sha256", "Checksum `algorithm` of -verify-source-manifest and -block-checksums: crc32c, md5, sha1, sha256 or sha512.")
+	scrub          = flag.String("scrub", "", "Verify a file against a block checksums sidecar `file` instead of copying.")
+	compareWindow  = flagSize("compare-window", 0, "Compare and rewrite -delta copies in windows of `size`, 8M by default.")
+	dryRun         = flag.Bool("dry-run", false, "Check that the copies would succeed without writing anything.")
+	delta          = flag.Bool("delta", false, "Only write the chunks that differ from a same size destination.")
+	cowOnly        = flag.Bool("cow-only", false, "Clone the source with copy on write, and fail instead of copying the data when it can't.")
+	reflink        = flag.String("reflink", "", "Clone the source with copy on write: auto copies the data with a warning when it can't, always fails like -cow-only.")
+	punchHoles     = flag.Bool("punch-holes", false, "With -sparse, update an existing destination in place, punching holes where the source has them.")
+	sparse         = flagSparse("sparse", "Only copy the data extents of the source, keeping its holes in the destination. With =auto only for sources with unallocated blocks.")
+	followSource   = flag.Bool("follow", false, "Keep copying data appended to the source until it stops growing.")
+	followTimeout  = flag.Duration("follow-timeout", time.Minute, "Maximum time to keep following a growing source.")
+	fsync          = flag.Bool("s", false, "Sync file to disk after done copying data, same as -sync-data -sync-dir.")
+	syncData       = flag.Bool("sync-data", false, "Sync the copied data to disk.")
+	syncDir        = flag.Bool("sync-dir", false, "Sync the destination directory to disk after the copy.")
+	threads        = flag.Int("t", 0, "Specifies the number of threads used to copy data simultaneously.")
+	cleanTemps     = flag.Duration("clean-temps", 0, "Remove staging files of crashed -atomic copies older than `age` from the destination directory.")
+	atomicWrite    = flag.Bool("atomic", false, "Write to a staging file that replaces the destination only when the copy succeeded.")
+	touchDest      = flag.Bool("touch-dest", false, "Create the destination at full size and say so on stderr before copying the data.")
+	appendMode     = flag.Bool("append", false, "Append source data to the end of the destination file.")
+	parents        = flag.Bool("D", false, "Create missing parent directories of the destination.")
+	useSyncRange   = flag.Bool("sync-range", false, "Sync data with sync_file_range instead of msync where supported.")
+	profile        = flag.String("concurrency-profile", "", "Set -t, -j and -readahead for io-bound, balanced or cpu-bound copies.")
+	cpuAffinity    = flag.Bool("cpu-affinity", false, "Pin each copy thread to a distinct CPU (experimental).")
+	metadataOnly   = flag.Bool("metadata-only", false, "Create the destination with the source size and mode without copying data.")
+	noPreserve     = flag.Bool("no-preserve-root", false, "Allow protected system paths as destination.")
+	verifyManifest = flag.String("verify-source-manifest", "", "Verify sources against a sha256sum style `file` of the -hash algorithm before copying.")
+	strictManifest = flag.Bool("strict-manifest", false, "Refuse to copy sources not listed in the -verify-source-manifest file.")
+	progressFD     = flag.Int("progress-fd", -1, "Write done/total progress records to file descriptor `fd`.")
+	preserve       = flag.Bool("p", false, "Preserve the permissions and the nanosecond timestamps of the source.")
+	keepContext    = flag.Bool("preserve-context", false, "Give the destination the SELinux security context of the source.")
+	forceType      = flag.Bool("force-type-change", false, "Replace a destination that is an empty directory or a socket with the copied file.")
+	noDerefDest    = flag.Bool("no-dereference-dest", false, "Replace a destination symlink instead of overwriting its target.")
+	keepExtents    = flag.Bool("preserve-extents", false, "Allocate the destination with the extent layout of the source before copying.")
+	preallocMode   = flag.String("preallocate-mode", "", "Reserve the space of the destination before copying, with full or keep-size allocation.")
+	readOnly       = flag.Bool("read-only-result", false, "Make the destination read only after a successful copy, keeping its execute bits.")
+	hugepage       = flag.Bool("hugepage", false, "Advise the kernel to back large chunk mappings with transparent huge pages.")
+	method         = flag.String("method", "mmap", "Copy the chunks of each thread by mapping them, mmap, or with pread and pwrite, pread.")
+	bufferSize     = flagSize("buffer-size", 1<<20, "`Size` of the buffer of each thread with -method=pread.")
+	maxRSS         = flagSize("max-rss", 0, "Keep at most `size` of the files mapped at once, dropping copied pages from the mappings.")
+	noMmap         = flag.Bool("no-mmap", false, "Never map the files, the same as -method=pread.")
+	populate       = flag.Bool("mmap-populate", false, "Prefault the source pages of each chunk before copying.")
+	compress       = flag.String("compress", "", "Compress the destination with the given algorithm, only gzip is supported.")
+	decompress     = flag.Bool("decompress", false, "Decompress a gzip compressed source.")
+	minChunk       = flagSize("min-chunk", 4<<20, "Minimum `size` of the chunk copied by each thread.")
+	quickCheck     = flag.Bool("quick-check", false, "Skip copies whose destination has the size and modification time of the source.")
+	paranoidRead   = flag.Bool("paranoid-read", false, "Read the source a second time after the copy, and fail if the two reads differ.")
+	readahead      = flagSize("readahead", 0, "Hint the kernel to read `size` ahead of the position of streamed copies.")
+	splitSize      = flagSize("split", 0, "Copy the source into numbered destination pieces of `size` bytes, listed in a .split manifest.")
+	join           = flag.Bool("join", false, "Reassemble the pieces listed in a .split manifest source into the destination.")
+	streamBelow    = flagSize("stream-below", 64<<10, "Copy files smaller than `size` with a single stream instead of mapping them.")
+	humanReadable  = flag.Bool("human-readable", false, "Print sizes with binary units and the throughput of lists.")
+	showCRC        = flag.Bool("crc", false, "Print the CRC32C of the copied data, and add it to the -progress-fd records.")
+	expectCRC      = flag.String("expect-crc", "", "Fail when the CRC32C of the copied data is not the given `hex` value. Implies -crc.")
+	onComplete     = flag.String("on-complete", "", "Run `command` with the shell after each successful copy, with PCP_SRC, PCP_DST and PCP_BYTES set.")
+	onError        = flag.String("on-error", "", "Run `command` with the shell after each failed copy, with PCP_ERROR also set.")
+	hookErrors     = flag.Bool("hook-errors", false, "Fail a copy when its -on-complete command fails.")
+	format         = flag.String("format", "", "Print the result of each copy with a Go template, e.g. '{{.BytesCopied}} {{.Duration}}'.")
+
+	fromFile           = flag.String("from-file", "", "Read source and destination pairs from a list file, - for standard input.")
+	targetDir          = flag.String("target-dir", "", "Copy the sources of a list file into this directory.")
+	renamePattern      = flag.String("rename-pattern", "", "Rename files copied into the target directory, e.g. {base}.bak or prefix-{name}.")
+	fileJobs           = flag.Int("j", 1, "Number of files of a list copied in parallel.")
+	maxOpenFiles       = flag.Int("max-open-files", 0, "Maximum number of files kept open by the copies of a list, 0 for the process limit.")
+	checkpointFile     = flag.String("checkpoint", "", "Record the completed copies of a list in `file`, to continue it with -resume.")
+	checkpointInterval = flag.Duration("checkpoint-interval", 5*time.Second, "How often the -checkpoint file is synced to disk.")
+	resume             = flag.Bool("resume", false, "Skip the copies of a list recorded as completed in the -checkpoint file.")
+	maxErrors          = flag.Int("max-errors", 0, "Abort a list once `count` copies failed, 0 to copy the rest of the list whatever fails.")
+	stopOnError        = flag.Bool("stop-on-error", false, "Stop copying the files of a list at the first failure.")
 )
 
+// Destinations that are refused unless -no-preserve-root is set
+var protectedRoots = []string{"/", "/bin", "/boot", "/dev", "/etc", "/lib", "/proc", "/sbin", "/sys", "/usr", "/var"}
+
+// Returned when the user declines to overwrite an existing destination
+var errNotOverwritten = errors.New("not overwritten")
+
+// Returned when -quick-check finds the destination already up to date
+var errUpToDate = errors.New("up to date")
+
+// Template for printing copy results, set by -format
+var outputFormat *template.Template
+
+// Serializes overwrite prompts of parallel batch copies
+var promptLock sync.Mutex
+
+// Input and output of the overwrite prompt, replaceable by tests and embedders
+var (
+	promptIn  io.Reader = os.Stdin
+	promptOut io.Writer = os.Stdout
+)
+
+// Smallest chunk worth backing with transparent huge pages
+const hugepageSize = 2 << 20
+
+// Page size used to align chunks and mappings.
+// Tests can override it to check the chunking logic at small sizes.
+var pageSize = int64(os.Getpagesize())
+
+// Function used to map file chunks in memory.
+// Tests can override it to inject mapping failures at specific offsets.
+var mmapFunc = unix.Mmap
+
+// Function used to sync mapped destination chunks with -sync-data.
+// Tests can override it to count the syncs.
+var msyncFunc = unix.Msync
+
+// Function used to clone the source into the destination.
+// Tests can override it to check clones on filesystems without reflinks.
+var cloneFunc = cloneFile
+
+// Function used to get the free space of the destination filesystem.
+// Tests can override it to check copies that don't fit.
+var freeSpaceFunc = freeSpace
+
+// Flags used to map source chunks. The source is only read, so MAP_PRIVATE
+// works too and keeps the mapping apart from the shared writeback state of
+// the file, at the cost of private page tables per thread. Destinations are
+// always mapped MAP_SHARED, writes to a private mapping never reach the file.
+var srcMapFlags = unix.MAP_SHARED
+
 func main() {
-	flag.Parse()
 	var err error
 	log.SetFlags(log.Lshortfile)
-
-	args := flag.Args()
-	if len(args) != 2 {
-		log.Fatalln("Usage", os.Args[0], "[options] source destination")
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		err = bench(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "selftest" {
+		err = selftest(os.Args[2:])
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
 	}
+	flag.Parse()
 
+	if *profile != "" {
+		err = applyProfile(*profile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
 	if *threads <= 0 {
 		*threads = runtime.NumCPU()
+		autoThreads = true
+	}
+	if *fsync {
+		*syncData, *syncDir = true, true
+	}
+	if *expectCRC != "" {
+		*showCRC = true
+	}
+	switch *method {
+	case "mmap":
+	case "pread":
+		*noMmap = true
+	case "iouring":
+		// No io_uring binding to build on, so it falls back as it would
+		// on kernels without io_uring
+		log.Println("io_uring is not available in this build, copying with -method=mmap")
+		*method = "mmap"
+	default:
+		log.Fatalln("unsupported copy method", *method+", use mmap or pread")
+	}
+	if *cpuAffinity && !affinitySupported {
+		log.Println("CPU affinity is not supported on this platform, ignoring -cpu-affinity")
+		*cpuAffinity = false
+	}
+	if *keepExtents && !layoutSupported {
+		log.Println("extent layouts are not supported on this platform, ignoring -preserve-extents")
+		*keepExtents = false
+	}
+	if *preallocMode != "" && !layoutSupported {
+		log.Println("preallocation is not supported on this platform, ignoring -preallocate-mode")
+		*preallocMode = ""
+	}
+	if *paranoidRead && !dropCacheSupported {
+		log.Println("the page cache can't be dropped on this platform, -paranoid-read may read the source again from memory")
+	}
+	if *keepContext && !contextSupported {
+		log.Println("SELinux contexts are not supported on this platform, ignoring -preserve-context")
+		*keepContext = false
+	}
+
+	if *compress != "" && *compress != "gzip" {
+		log.Fatalln("unsupported compression", *compress+", only gzip is available")
+	}
+	if *noClobber && (*force || *appendMode || *delta) {
+		log.Fatalln("-n can't be used with -f, -append or -delta")
+	}
+	if *punchHoles && *sparse == "" {
+		log.Fatalln("-punch-holes needs -sparse")
+	}
+	if *delta && (*appendMode || (*sparse != "" && !*punchHoles)) {
+		log.Fatalln("-delta can't be used with -append, or with -sparse without -punch-holes")
+	}
+	if *checksumBlock <= 0 {
+		log.Fatalln("-checksum-block must be larger than 0")
+	}
+	if *bufferSize <= 0 {
+		log.Fatalln("-buffer-size must be larger than 0")
+	}
+	if *keepExtents && (*appendMode || *delta) {
+		log.Fatalln("-preserve-extents can't be used with -append or -delta")
+	}
+	switch *preallocMode {
+	case "", "full", "keep-size":
+	default:
+		log.Fatalln("unsupported preallocation mode", *preallocMode+", use full or keep-size")
+	}
+	if *preallocMode != "" && (*metadataOnly || *cowOnly || *keepExtents || *compress != "" || *decompress || *splitSize > 0 || *join) {
+		log.Fatalln("-preallocate-mode can't be used with -metadata-only, -cow-only, -preserve-extents, -compress, -decompress, -split or -join")
+	}
+	if *preallocMode == "full" && *punchHoles {
+		log.Fatalln("-preallocate-mode=full would fill the holes punched by -punch-holes, use keep-size")
+	}
+	if *atomicWrite && (*appendMode || *delta) {
+		log.Fatalln("-atomic can't be used with -append or -delta")
+	}
+	if *compress != "" && *decompress {
+		log.Fatalln("-compress and -decompress can't be used together")
+	}
+	if (*compress != "" || *decompress) && (*appendMode || *metadataOnly) {
+		log.Fatalln("-compress and -decompress can't be used with -append or -metadata-only")
+	}
+	switch *reflink {
+	case "", "never":
+	case "auto":
+		if *cowOnly {
+			log.Fatalln("-reflink=auto can't be used with -cow-only")
+		}
+	case "always":
+		*cowOnly = true
+	default:
+		log.Fatalln("unsupported reflink mode", *reflink+", use never, auto or always")
+	}
+	if *reflink == "auto" && (*appendMode || *delta || *sparse != "" || *compress != "" || *decompress || *metadataOnly || *followSource || *showCRC ||
+		*splitSize > 0 || *join) {
+		log.Fatalln("-reflink=auto can't be used with -append, -delta, -sparse, -compress, -decompress, -metadata-only, -follow, -crc, -split or -join")
+	}
+	if *cowOnly && (*appendMode || *delta || *sparse != "" || *compress != "" || *decompress || *metadataOnly || *followSource || *showCRC) {
+		log.Fatalln("-cow-only can't be used with -append, -delta, -sparse, -compress, -decompress, -metadata-only, -follow or -crc")
+	}
+	// The destination must be the final path, with its data still to come
+	if *touchDest && (*atomicWrite || *cowOnly || *reflink == "auto" || *compress != "" || *decompress || *splitSize > 0 || *join) {
+		log.Fatalln("-touch-dest can't be used with -atomic, -cow-only, -reflink, -compress, -decompress, -split or -join")
+	}
+	if *splitSize%pageSize != 0 {
+		log.Fatalln("-split must be a multiple of the page size,", pageSize, "bytes")
+	}
+	if (*splitSize > 0 || *join) && (*appendMode || *delta || *sparse != "" || *compress != "" || *decompress || *metadataOnly ||
+		*followSource || *cowOnly || *dryRun || *blockChecksums != "") {
+		log.Fatalln("-split and -join can't be used with -append, -delta, -sparse, -compress, -decompress, -metadata-only, -follow, -cow-only, -dry-run or -block-checksums")
+	}
+	if *splitSize > 0 && *join {
+		log.Fatalln("-split and -join can't be used together")
+	}
+	if *join && *showCRC {
+		log.Fatalln("-crc can't be used with -join")
+	}
+	if *showCRC && (*compress != "" || *decompress || *metadataOnly) {
+		log.Fatalln("-crc can't be used with -compress, -decompress or -metadata-only")
+	}
+
+	if _, err = lookupHash(*hashName); err != nil {
+		log.Fatalln(err)
+	}
+	if *verifyManifest != "" {
+		manifest, err = loadManifest(*verifyManifest)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	source := args[0]
-	destination := args[1]
-	if source == destination {
-		log.Fatalln(source, "and", destination, "are the same file")
+	if *format != "" {
+		outputFormat, err = template.New("format").Funcs(template.FuncMap{"human": humanSize}).Parse(*format)
+		if err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	if !*force {
-		_, err = os.Stat(destination)
-		if !os.IsNotExist(err) {
-			fmt.Printf("File %s already exists, overwrite? (y/N)", destination)
-			var answer string
-			fmt.Scanln(&answer)
-			if strings.ToLower(answer) != "y" {
-				log.Fatalln("not overwritten")
-			}
+	if *progressFD >= 0 {
+		w := os.NewFile(uintptr(*progressFD), "progress")
+		if _, err = w.Stat(); err != nil {
+			log.Fatalln("invalid -progress-fd:", err)
 		}
+		defer reportProgress(w)()
+	}
+
+	args := flag.Args()
+	if *scrub != "" {
+		if len(args) != 1 {
+			log.Fatalln("Usage", os.Args[0], "-scrub=sidecar file")
+		}
+		err = scrubFile(args[0], *scrub, *threads)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+	if *fromFile != "" {
+		if *blockChecksums != "" || *showCRC {
+			log.Fatalln("-block-checksums and -crc can't be used with -from-file")
+		}
+		if *fromFile == "-" && !*force && !*noClobber {
+			log.Fatalln("-from-file=- needs -f or -n, the overwrite prompt can't read answers from the list")
+		}
+		if len(args) != 0 {
+			log.Fatalln("Usage", os.Args[0], "[options] -from-file=list")
+		}
+		err = batchCopy(*fromFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if len(args) != 2 {
+		log.Fatalln("Usage", os.Args[0], "[options] source destination")
+	}
+	res, err := copyFile(args[0], args[1], *threads)
+	err = runHook(args[0], args[1], res, err)
+	if errors.Is(err, errUpToDate) {
+		fmt.Println(err)
+		return
 	}
-	err = pcopy(source, destination)
 	if err != nil {
 		log.Fatalln(err)
 	}
+	if *dryRun && outputFormat == nil {
+		fmt.Println(res.Plan)
+	}
+	if *showCRC && !*dryRun {
+		err = checkCRC(args[0])
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if outputFormat != nil {
+		err = res.print(os.Stdout)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+}
+
+// Check destination and copy a single file
+func copyFile(source, destination string, threads int) (*result, error) {
+	if source == destination || sameFile(source, destination) {
+		return nil, fmt.Errorf("%s and %s are the same file", source, destination)
+	}
+	if !*noPreserve && isProtected(destination) {
+		return nil, fmt.Errorf("refusing to write to protected path %s, use -no-preserve-root to override", destination)
+	}
+	if err := checkDestType(destination); err != nil {
+		return nil, err
+	}
+	if *dryRun {
+		return checkCopy(source, destination, threads)
+	}
+	if *quickCheck && unchanged(source, destination) {
+		return nil, fmt.Errorf("%s: %w", destination, errUpToDate)
+	}
+	if *cleanTemps > 0 {
+		err := cleanStaleTemps(filepath.Dir(destination), *cleanTemps)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	dstDir := filepath.Dir(destination)
+	if *parents {
+		err := os.MkdirAll(dstDir, 0755)
+		if err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dstDir); os.IsNotExist(err) {
+		return nil, fmt.Errorf("destination directory %s does not exist", dstDir)
+	}
+
+	if manifest != nil {
+		err := verifySource(source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Read before copying the data changes the access time
+	var attrs *unix.Stat_t
+	if *preserve {
+		attrs = new(unix.Stat_t)
+		err := unix.Stat(source, attrs)
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: source, Err: err}
+		}
+	}
 
+	res := &result{Source: source, Destination: destination}
+	start := time.Now()
+	var err error
+	switch {
+	case *compress != "" || *decompress:
+		res.Method = "gzip"
+		if *decompress {
+			res.Method = "gunzip"
+		}
+		res.BytesCopied, err = zcopy(source, destination)
+	case *splitSize > 0:
+		res.Method = "split"
+		res.BytesCopied, err = splitCopy(source, destination, threads)
+	case *join:
+		res.Method = "join"
+		res.BytesCopied, err = joinCopy(source, destination, threads)
+	default:
+		res.BytesCopied, res.Method, err = pcopy(source, destination, threads)
+	}
+	res.Duration = time.Since(start)
+	if err == nil && *blockChecksums != "" {
+		err = writeChecksums(destination, *blockChecksums, threads)
+	}
+	// Devices and pipes keep their own attributes
+	if err == nil && (attrs != nil || *readOnly) {
+		if info, serr := os.Stat(destination); serr == nil && info.Mode().IsRegular() {
+			if attrs != nil {
+				err = preserveAttrs(source, attrs, destination)
+			}
+			// Last, so nothing above fails on the read only destination
+			if err == nil && *readOnly {
+				err = makeReadOnly(destination)
+			}
+		}
+	}
+	if err == nil && *syncDir {
+		err = syncDirectory(filepath.Dir(destination))
+	}
+	return res, err
 }
 
-// Copy file in parallel
-func pcopy(source, destination string) error {
+// Copy file in parallel, returning the bytes copied and the copy method
+func pcopy(source, destination string, threads int) (int64, string, error) {
 	src, err := os.OpenFile(source, os.O_RDONLY, 0644)
 	if err != nil {
-		return err
+		return 0, "", err
 	}
 	defer src.Close()
-	stat, err := src.Stat()
+	stat, srcSize, err := sourceSize(src)
 	if err != nil {
-		return err
+		return 0, "", err
+	}
+	progress.total.Add(srcSize)
+
+	// Fail early when the data won't fit in the destination filesystem
+	need := dataSize(src, stat, srcSize)
+	info, statErr := os.Stat(destination)
+	if statErr == nil {
+		if isBlockDevice(info) || isNamedPipe(info) {
+			need = 0
+		} else if !*appendMode && !*atomicWrite {
+			need -= info.Size()
+		}
 	}
-	if !stat.Mode().IsRegular() {
-		return errors.New("pcp only works on regular files")
+	// Clones share the data of the source
+	if need > 0 && !*metadataOnly && !*cowOnly {
+		avail, err := freeSpaceFunc(filepath.Dir(destination))
+		if err == nil && need > avail {
+			return 0, "", fmt.Errorf("insufficient space: need %d bytes, have %d", need, avail)
+		}
 	}
-	srcMode := stat.Mode().Perm()
-	srcSize := stat.Size()
 
-	dst, err := os.OpenFile(destination, os.O_RDWR|os.O_CREATE, srcMode)
+	dst, err := openTarget(destination, os.O_RDWR, stat.Mode().Perm())
 	if err != nil {
-		return err
+		return 0, "", err
 	}
-	if srcSize == 0 {
-		err = dst.Close()
-		if err != nil {
-			return err
+	method := copyMethod(srcSize, info, statErr)
+	// Clones share the data of the source, other copies say why they
+	// copy it instead
+	var n int64
+	cloned := false
+	if *reflink == "auto" && stat.Mode().IsRegular() && (statErr != nil || info.Mode().IsRegular()) {
+		err = cloneTruncated(src, dst.File)
+		if err == nil {
+			n, method, cloned = srcSize, "clone", true
+			progress.done.Add(srcSize)
+			if *syncData {
+				err = dst.Sync()
+			}
+		} else {
+			log.Printf("%s: can't clone %s, copying the data with %s: %v", destination, source, method, err)
 		}
-		return nil
 	}
+	if !cloned {
+		n, err = copyFiles(src, dst.File, threads)
+	}
+	if err == nil && *followSource && stat.Mode().IsRegular() && !*metadataOnly {
+		var tail int64
+		tail, err = follow(src, dst.File, srcSize)
+		n += tail
+	}
+	if err == nil && *keepContext {
+		err = copyContext(src, dst.File)
+	}
+	return n, method, dst.finish(err)
+}
 
-	err = dst.Truncate(srcSize)
-	if err != nil {
-		dst.Close()
+// Clone the source into an empty destination. FICLONE never shrinks its
+// target, so the old data of a larger one must be dropped first, like
+// the O_TRUNC of cp --reflink.
+func cloneTruncated(src, dst *os.File) error {
+	if err := dst.Truncate(0); err != nil {
 		return err
 	}
+	return cloneFunc(src, dst)
+}
 
-	// Don't run parallel jobs for small files
-	if srcSize < int64(256*os.Getpagesize()) {
-		*threads = 1
+// Copy the data of an open source to an open destination in parallel
+func copyFiles(src, dst *os.File, threads int) (int64, error) {
+	srcStat, srcSize, err := sourceSize(src)
+	if err != nil {
+		return 0, err
+	}
+	dstStat, err := dst.Stat()
+	if err != nil {
+		return 0, err
+	}
+	// Pipes can't be mapped or truncated, their reader gets a stream
+	if isNamedPipe(dstStat) && !*cowOnly {
+		return pipeCopy(src, dst)
+	}
+	// Never fall back to copying the data, it could fill the filesystem
+	if *cowOnly {
+		err = cloneTruncated(src, dst)
+		if err != nil {
+			return 0, fmt.Errorf("-cow-only: can't clone %s to %s: %w", src.Name(), dst.Name(), err)
+		}
+		if *syncData {
+			err = dst.Sync()
+		}
+		progress.done.Add(srcSize)
+		return srcSize, err
+	}
+	// Appended data starts at the current end of the destination
+	var dstOffset int64
+	if *appendMode {
+		if isBlockDevice(dstStat) {
+			return 0, errors.New("can't append to a block device")
+		}
+		dstOffset = dstStat.Size()
+	}
+	// Devices are written in place and can't grow to fit the source
+	if isBlockDevice(dstStat) {
+		devSize, err := deviceSize(dst)
+		if err != nil {
+			return 0, err
+		}
+		if srcSize > devSize {
+			return 0, fmt.Errorf("source of %d bytes doesn't fit in the %d bytes of device %s", srcSize, devSize, dst.Name())
+		}
+	}
+	// Sparse copies skip the holes of the source, devices can't have holes
+	sparseCopy := *sparse != "" && srcStat.Mode().IsRegular() && !isBlockDevice(dstStat) &&
+		srcSize > 0 && srcSize >= *streamBelow
+	// Fully allocated sources, the common case, have no hole to look for
+	if sparseCopy && *sparse == "auto" {
+		sparseCopy = hasHoles(src, srcSize)
+	}
+	// Set the exact destination size before any data is mapped, so no
+	// trailing data is left behind when overwriting a larger file.
+	// Block devices have a fixed size and can't be truncated.
+	if !isBlockDevice(dstStat) {
+		// Drop any existing data, so placeholders, sparse copies and
+		// reproduced extent layouts start from holes. Sparse updates
+		// punch the holes of the source into the existing data instead.
+		if *metadataOnly || (sparseCopy && !*punchHoles) || *keepExtents {
+			err = dst.Truncate(dstOffset)
+		}
+		if err == nil {
+			err = dst.Truncate(dstOffset + srcSize)
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Filesystems without holes, like FAT, allocate and zero the
+		// extended file, so skipping the holes of the source saves nothing
+		if sparseCopy && !*punchHoles && !dstHolesFunc(dst, dstOffset+srcSize) {
+			log.Printf("%s: the filesystem doesn't support holes, copying all data", dst.Name())
+			sparseCopy = false
+		}
+		// Best effort, the copy allocates as usual where it fails
+		if *keepExtents && srcStat.Mode().IsRegular() {
+			if err := allocateLike(src, dst, srcSize); err != nil {
+				log.Printf("%s: can't reproduce the extents of the source, allocating as usual: %v", dst.Name(), err)
+			}
+		}
+	}
+	// Other processes waiting for the path can open it from here on
+	if *touchDest {
+		fmt.Fprintf(os.Stderr, "%s: created with %d bytes\n", dst.Name(), dstOffset+srcSize)
+	}
+	if *metadataOnly {
+		return 0, nil
+	}
+	// Sources without a known size, like pipes, character devices
+	// or files under /proc, are streamed until EOF. Mapping small
+	// files costs more than a plain copy.
+	if srcSize == 0 || srcSize < *streamBelow {
+		n, err := scopy(src, dst, dstOffset)
+		// The size of pipes and character devices is only known now
+		if srcSize == 0 {
+			progress.total.Add(n)
+		}
+		// Streams of unknown size can't be read again
+		if err == nil && *paranoidRead && srcSize > 0 {
+			err = rereadSource(src, dst, srcSize, dstOffset, threads)
+		}
+		return n, err
+	}
+
+	t := &transfer{
+		src:  src,
+		dst:  dst,
+		errs: make(chan error, threads),
+		// Only unchanged data of a same size file can be kept
+		delta:  *delta && dstStat.Mode().IsRegular() && dstStat.Size() == srcSize && dstOffset == 0,
+		sparse: sparseCopy,
+	}
+	if t.sparse {
+		t.extents, err = dataExtents(src, srcSize)
+		if err != nil {
+			return 0, err
+		}
+		if *punchHoles {
+			err = punchSourceHoles(dst, t.extents, dstOffset, srcSize)
+			// The holes of the source are written as zeros instead
+			if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+				log.Printf("%s: the filesystem can't punch holes, copying all data", dst.Name())
+				t.sparse, err = false, nil
+			}
+			if err != nil {
+				return 0, err
+			}
+		}
+	}
+	// Running out of space fails here instead of in the middle of the copy.
+	// Sparse copies only reserve their data with keep-size.
+	if *preallocMode != "" && !isBlockDevice(dstStat) {
+		ranges := []extent{{0, srcSize}}
+		if *preallocMode == "keep-size" {
+			ranges = t.dataRanges(0, srcSize)
+		}
+		err = preallocate(dst, ranges, dstOffset, *preallocMode == "keep-size")
+		if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+			log.Printf("%s: the filesystem can't preallocate, allocating as the data is written", dst.Name())
+			err = nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	// The first part of large copies picks the thread count for the rest
+	var calibrated int64
+	if autoThreads && srcSize >= calibrateMin && srcStat.Mode().IsRegular() {
+		t.rss = rssShare(threads)
+		threads, calibrated = t.calibrate(srcSize, dstOffset, threads)
+	}
+	t.rss = rssShare(threads)
+	chunks := planChunks(srcSize-calibrated, threads)
+	for i := range chunks {
+		chunks[i].Offset += calibrated
+	}
+	for i, c := range chunks {
+		t.wg.Add(1)
+		go func(worker int, srcOffset, dstOffset, size int64) {
+			if *cpuAffinity {
+				if err := pinWorker(worker); err != nil {
+					log.Println("CPU affinity:", err)
+				}
+			}
+			t.mcopy(srcOffset, dstOffset, size)
+		}(i, c.Offset, dstOffset+c.Offset, c.Size)
+	}
+	t.wg.Wait()
+	close(t.errs)
+	if err = <-t.errs; err != nil {
+		return 0, err
+	}
+	if *syncData && *useSyncRange {
+		err = syncRangeDone(dst)
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	chunk := align(srcSize / int64(*threads))
-	wg := new(sync.WaitGroup)
-	var startOffset, endOffset int64
-	endOffset = chunk
-	for i := 0; i < *threads; i++ {
-		if i == *threads-1 {
-			endOffset = srcSize
+	// Make sure nothing truncated the file while copying
+	if !isBlockDevice(dstStat) {
+		dstStat, err = dst.Stat()
+		if err != nil {
+			return 0, err
+		}
+		if dstStat.Size() != dstOffset+srcSize {
+			return 0, fmt.Errorf("size mismatch, expected %d bytes, destination has %d", dstOffset+srcSize, dstStat.Size())
+		}
+	}
+	// The mappings of the first read are gone, so its pages can be dropped
+	if *paranoidRead {
+		err = rereadSource(src, dst, srcSize, dstOffset, threads)
+		if err != nil {
+			return 0, err
 		}
-		wg.Add(1)
-		go mcopy(src, dst, startOffset, endOffset, wg)
-		startOffset += chunk
-		endOffset += chunk
 	}
-	wg.Wait()
-	return dst.Close()
+	written := t.written.Load()
+	if t.delta {
+		fmt.Printf("%s: %s written, %s unchanged\n", dst.Name(), formatSize(written), formatSize(srcSize-written))
+	}
+	return written, nil
+}
+
+// Get the size of the data to copy from a source,
+// 0 for sources that are streamed until EOF
+func sourceSize(src *os.File) (os.FileInfo, int64, error) {
+	stat, err := src.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	size := stat.Size()
+	if isBlockDevice(stat) {
+		size, err = deviceSize(src)
+	} else if stat.Mode()&(os.ModeCharDevice|os.ModeNamedPipe) != 0 {
+		size = 0
+	} else if !stat.Mode().IsRegular() {
+		err = errors.New("pcp only works on regular files, devices and pipes")
+	}
+	return stat, size, err
+}
+
+// State shared by the threads copying a file
+type transfer struct {
+	src, dst *os.File
+	wg       sync.WaitGroup
+	errs     chan error
+	written  atomic.Int64 // bytes written to the destination
+	delta    bool         // only write data that differs from the destination
+	sparse   bool         // only copy the data extents of the source
+	extents  []extent     // data extents of a sparse source
+	failed   atomic.Bool  // set by the first failing thread to stop the others
+	rss      int64        // bytes each thread may keep mapped with -max-rss
+	out      chunkDest    // where -no-mmap chunks are written, dst when nil
 }
 
-// Map file chunks in memory and copy data
-func mcopy(src, dst *os.File, start, end int64, wg *sync.WaitGroup) {
-	defer wg.Done()
+// Report the failure of a thread and stop the rest of the copy
+func (t *transfer) fail(err error) {
+	t.failed.Store(true)
+	t.errs <- err
+}
+
+// Copy a chunk of the file, mapping it in memory unless -no-mmap is set
+func (t *transfer) mcopy(srcOffset, dstOffset, size int64) {
+	defer t.wg.Done()
+	if t.failed.Load() {
+		return
+	}
 	// Set runtime to panic instead of crashing on bus errors.
 	debug.SetPanicOnFault(true)
 	defer func() {
 		if e := recover(); e != nil {
-			log.Fatalln(e)
+			t.fail(&copyError{"copy", dstOffset, size, fmt.Errorf("%v", e)})
 		}
 	}()
-	s, err := unix.Mmap(int(src.Fd()), start, int(end-start), unix.PROT_READ, unix.MAP_SHARED)
+	if *noMmap {
+		if err := t.rwCopy(srcOffset, dstOffset, size); err != nil {
+			t.fail(err)
+		}
+		return
+	}
+	t.copyChunk(srcOffset, dstOffset, size)
+}
+
+// Logs the first chunk too large to map only once
+var enomemOnce sync.Once
+
+// Copy a chunk, splitting it in halves that are mapped one after the other
+// when it is too large to map. Address space runs out before memory does
+// on 32 bit systems, or with a low RLIMIT_AS.
+func (t *transfer) copyChunk(srcOffset, dstOffset, size int64) {
+	err := t.mapCopy(srcOffset, dstOffset, size)
+	if errors.Is(err, unix.ENOMEM) && size > pageSize {
+		enomemOnce.Do(func() {
+			log.Printf("%v, copying in smaller parts", err)
+		})
+		// The first part is at least a page, so chunks of less than
+		// two pages split into a page and the rest
+		half := align(size / 2)
+		if half < pageSize {
+			half = pageSize
+		}
+		t.copyChunk(srcOffset, dstOffset, half)
+		t.copyChunk(srcOffset+half, dstOffset+half, size-half)
+		return
+	}
 	if err != nil {
-		log.Fatalln(err)
+		t.fail(err)
+	}
+}
+
+// Map a chunk of the source and the destination in memory and copy the data
+func (t *transfer) mapCopy(srcOffset, dstOffset, size int64) error {
+	if t.failed.Load() {
+		return nil
+	}
+	srcFlags := srcMapFlags
+	if *populate {
+		srcFlags |= mapPopulate
+	}
+	s, err := mmapFunc(int(t.src.Fd()), srcOffset, int(size), unix.PROT_READ, srcFlags)
+	if err != nil {
+		return &copyError{"mmap", srcOffset, size, err}
 	}
 	defer unix.Munmap(s)
 	err = unix.Madvise(s, unix.MADV_SEQUENTIAL)
 	if err != nil {
-		log.Fatalln(err)
+		return &copyError{"madvise", srcOffset, size, err}
 	}
-	d, err := unix.Mmap(int(dst.Fd()), start, int(end-start), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	// Mappings must start at a page boundary, data is copied
+	// after the padding when the destination offset is not aligned.
+	dstStart := align(dstOffset)
+	pad := dstOffset - dstStart
+	d, err := mmapFunc(int(t.dst.Fd()), dstStart, int(pad+size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
 	if err != nil {
-		log.Fatalln(err)
+		return &copyError{"mmap", dstStart, pad + size, err}
 	}
-	n := copy(d, s)
-	if int64(n) != (end - start) {
-		unix.Munmap(d)
-		log.Fatalln("Short write")
+	// Only a hint, kernels and filesystems without huge pages ignore it
+	if *hugepage && madvHugepage != 0 && size >= hugepageSize {
+		unix.Madvise(s, madvHugepage)
+		unix.Madvise(d, madvHugepage)
 	}
-	if *fsync {
-		err = unix.Msync(d, unix.MS_SYNC)
+	// Holes of sparse copies are done without copying them
+	holes := size
+	// Delta copies compare and rewrite the data one window at a time
+	window := int64(progressStep)
+	if t.delta && *compareWindow > 0 {
+		window = *compareWindow
+	}
+	// Windows of both files must fit in the -max-rss share of the thread
+	var mapped, released int64
+	if t.rss > 0 && 2*window > t.rss {
+		window = align(t.rss / 2)
+		if window < pageSize {
+			window = pageSize
+		}
+	}
+	for _, r := range t.dataRanges(srcOffset, size) {
+		holes -= r.length
+		end := r.offset - srcOffset + r.length
+		for off := r.offset - srcOffset; off < end; off += window {
+			if t.failed.Load() {
+				unix.Munmap(d)
+				return nil
+			}
+			step := end - off
+			if step > window {
+				step = window
+			}
+			ss := s[off:][:step]
+			dd := d[pad+off:][:step]
+			if !t.delta || !bytes.Equal(dd, ss) {
+				n := copy(dd, ss)
+				if int64(n) != step {
+					unix.Munmap(d)
+					return &copyError{"write", dstOffset + off, step, errors.New("short write")}
+				}
+				t.written.Add(int64(n))
+			}
+			progress.done.Add(step)
+			mapped += 2 * step
+			if t.rss > 0 && mapped+2*window > t.rss {
+				released = dropPages(s, d, pad, released, off+step)
+				mapped = 0
+			}
+		}
+	}
+	progress.done.Add(holes)
+	if *showCRC {
+		// Hole pages read back as zeros from the source mapping
+		for off := int64(0); off < size; off += progressStep {
+			step := size - off
+			if step > progressStep {
+				step = progressStep
+			}
+			addCRC(srcOffset+off, step, crc32.Checksum(s[off:][:step], castagnoli))
+			if t.rss > 0 {
+				dropPages(s, nil, 0, off, off+step)
+			}
+		}
+	}
+	if *syncData {
+		if *useSyncRange {
+			err = syncRange(t.dst, dstOffset, size)
+		}
+		if !*useSyncRange || err == unix.ENOSYS {
+			err = msyncFunc(d, unix.MS_SYNC)
+		}
 		if err != nil {
 			unix.Munmap(d)
-			log.Fatalln(err)
+			return &copyError{"sync", dstOffset, size, err}
 		}
 	}
 	err = unix.Munmap(d)
 	if err != nil {
-		log.Fatalln(err)
+		return &copyError{"munmap", dstStart, pad + size, err}
+	}
+	return nil
+}
+
+// Failure of a copy thread, with the operation and the file range it failed on
+type copyError struct {
+	Op     string // mmap, madvise, copy, write, sync or munmap
+	Offset int64
+	Length int64
+	Err    error
+}
+
+func (e *copyError) Error() string {
+	return fmt.Sprintf("%s at offset %d, %d bytes: %v", e.Op, e.Offset, e.Length, e.Err)
+}
+
+func (e *copyError) Unwrap() error {
+	return e.Err
+}
+
+// Outcome of a single file copy
+type result struct {
+	Source      string
+	Destination string
+	BytesCopied int64
+	Duration    time.Duration
+	Method      string // clone, mmap, pread, stream, pipe, gzip, gunzip, split, join or metadata-only
+	Plan        *plan  // how the copy would be done, only set by -dry-run
+}
+
+// Print a copy result using the output format template
+func (r *result) print(w io.Writer) error {
+	err := outputFormat.Execute(w, r)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w)
+	return err
+}
+
+// Create and open the destination file. Unless overwriting or appending,
+// the file is created with O_EXCL so the existence check and the creation
+// are a single atomic operation, and an existing file is only opened after
+// the user confirms to overwrite it. With -n it is never overwritten.
+func openDestination(destination string, flags int, mode os.FileMode) (*os.File, error) {
+	// Writing to an existing pipe overwrites nothing. Opening it write only
+	// waits for a reader, instead of buffering data nobody reads.
+	if fi, err := os.Stat(destination); err == nil && isNamedPipe(fi) {
+		return os.OpenFile(destination, os.O_WRONLY, 0)
+	}
+	flags |= os.O_CREATE
+	if *noDerefDest {
+		fi, err := os.Lstat(destination)
+		if err == nil && fi.Mode()&fs.ModeSymlink != 0 {
+			return replaceSymlink(destination, flags, mode)
+		}
+	}
+	if *force || *appendMode || *delta {
+		return os.OpenFile(destination, flags, mode)
+	}
+	f, err := os.OpenFile(destination, flags|os.O_EXCL, mode)
+	if !errors.Is(err, fs.ErrExist) {
+		return f, err
+	}
+	if *noClobber {
+		return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+	}
+	if !confirm(destination) {
+		return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+	}
+	return os.OpenFile(destination, flags, mode)
+}
+
+// Remove a destination symlink and create a regular file in its place.
+// Nothing is written through the link, its target is left untouched.
+func replaceSymlink(destination string, flags int, mode os.FileMode) (*os.File, error) {
+	if *appendMode || *delta {
+		return nil, fmt.Errorf("destination %s is a symlink, it has no data to append to or compare with", destination)
+	}
+	if *noClobber {
+		return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
+	}
+	if !*force && !confirm(destination) {
+		return nil, fmt.Errorf("%s: %w", destination, errNotOverwritten)
 	}
+	err := os.Remove(destination)
+	if err != nil {
+		return nil, err
+	}
+	// Fail instead of following a link recreated in the meantime
+	return os.OpenFile(destination, flags|os.O_EXCL, mode)
+}
+
+// Ask the user to confirm overwriting an existing file
+func confirm(destination string) bool {
+	promptLock.Lock()
+	defer promptLock.Unlock()
+	fmt.Fprintf(promptOut, "File %s already exists, overwrite? (y/N)", destination)
+	var answer string
+	fmt.Fscanln(promptIn, &answer)
+	return strings.ToLower(answer) == "y"
+}
+
+// Check if an existing destination is the source under another name, like
+// a hard link, a symlink or a bind mount, by comparing device and inode.
+// Network mounts can show the same file with another device and inode,
+// which this can't detect.
+func sameFile(source, destination string) bool {
+	srcStat, err := os.Stat(source)
+	if err != nil {
+		return false
+	}
+	stat := os.Stat
+	// Only the link itself is replaced
+	if *noDerefDest {
+		stat = os.Lstat
+	}
+	dstStat, err := stat(destination)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(srcStat, dstStat)
+}
+
+// Sync a directory, making the creation or the rename of a file in it durable
+func syncDirectory(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Check if an existing destination has the size and modification time of
+// the source, without reading any data
+func unchanged(source, destination string) bool {
+	srcStat, err := os.Stat(source)
+	if err != nil || !srcStat.Mode().IsRegular() {
+		return false
+	}
+	dstStat, err := os.Stat(destination)
+	if err != nil || !dstStat.Mode().IsRegular() {
+		return false
+	}
+	return srcStat.Size() == dstStat.Size() && srcStat.ModTime().Equal(dstStat.ModTime())
+}
+
+// Check if a path resolves to one of the protected roots
+func isProtected(path string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, root := range protectedRoots {
+		if path == root {
+			return true
+		}
+	}
+	return false
+}
+
+// Check if file is a named pipe
+func isNamedPipe(stat os.FileInfo) bool {
+	return stat.Mode()&os.ModeNamedPipe != 0
+}
+
+// Check if file is a block device
+func isBlockDevice(stat os.FileInfo) bool {
+	return stat.Mode()&os.ModeDevice != 0 && stat.Mode()&os.ModeCharDevice == 0
 }
 
 // Align to OS page boundaries
 func align(size int64) int64 {
-	pageSize := int64(os.Getpagesize())
 	return (size / pageSize) * pageSize
 }
+
+// Split the -max-rss limit between the threads of a copy, 0 without a limit
+func rssShare(threads int) int64 {
+	if *maxRSS <= 0 || threads < 1 {
+		return 0
+	}
+	return *maxRSS / int64(threads)
+}
+
+// Drop the pages of the chunk range [from, to), already copied, from the
+// source mapping s and from the destination mapping d, which starts pad
+// bytes before the chunk. Dirty pages of the shared destination mapping
+// are kept in the page cache and written back as usual. Partial pages at
+// the end stay mapped. Returns the offset the next drop starts from.
+func dropPages(s, d []byte, pad, from, to int64) int64 {
+	start, end := align(from), align(to)
+	if end > start {
+		unix.Madvise(s[start:end], unix.MADV_DONTNEED)
+	}
+	if d != nil {
+		dStart, dEnd := align(pad+from), align(pad+to)
+		if dEnd > dStart {
+			unix.Madvise(d[dStart:dEnd], unix.MADV_DONTNEED)
+		}
+	}
+	return end
+}
@@ -0,0 +1,721 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Set a command line flag for the duration of a test
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	if f == nil {
+		t.Fatalf("no flag -%s", name)
+	}
+	old := f.Value.String()
+	if err := f.Value.Set(value); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		// The empty sparse mode is only spelled false
+		if f.Value.Set(old) != nil {
+			f.Value.Set("false")
+		}
+	})
+}
+
+// Write a file of size random bytes and return its data
+func writeRandom(t *testing.T, path string, size int64) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	rand.New(rand.NewSource(size)).Read(data)
+	if err := os.WriteFile(path, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Fail unless the file at path holds exactly want
+func assertData(t *testing.T, path string, want []byte) {
+	t.Helper()
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%s: got %d bytes, want %d", path, len(got), len(want))
+	}
+	if i := firstDiff(got, want); i >= 0 {
+		t.Fatalf("%s: data differs at offset %d", path, i)
+	}
+}
+
+// Offset of the first differing byte, -1 when a and b are the same
+func firstDiff(a, b []byte) int {
+	for i := range a {
+		if i >= len(b) || a[i] != b[i] {
+			return i
+		}
+	}
+	if len(b) > len(a) {
+		return len(a)
+	}
+	return -1
+}
+
+// Record the source ranges mapped by the copies of a test. The returned
+// function takes the ranges recorded since it was last called, by offset.
+func recordMaps(t *testing.T) func() []chunk {
+	var lock sync.Mutex
+	var maps []chunk
+	setMmap(t, func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+		if prot == unix.PROT_READ {
+			lock.Lock()
+			maps = append(maps, chunk{offset, int64(length)})
+			lock.Unlock()
+		}
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	return func() []chunk {
+		lock.Lock()
+		defer lock.Unlock()
+		taken := maps
+		maps = nil
+		sort.Slice(taken, func(i, j int) bool { return taken[i].Offset < taken[j].Offset })
+		return taken
+	}
+}
+
+// Replace the mapping function for the duration of a test
+func setMmap(t *testing.T, fn func(int, int64, int, int, int) ([]byte, error)) {
+	mmapFunc = fn
+	t.Cleanup(func() { mmapFunc = unix.Mmap })
+}
+
+func TestCopySizes(t *testing.T) {
+	setFlag(t, "f", "true")
+	// Small chunks, so every thread gets a part of the larger files
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	sizes := []int64{0, 1, pageSize - 1, pageSize, pageSize + 1, *streamBelow + 1, 5<<20 + 3}
+	maxThreads := runtime.NumCPU()
+	if maxThreads < 4 {
+		maxThreads = 4
+	}
+	dir := t.TempDir()
+	for _, size := range sizes {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", size))
+		data := writeRandom(t, src, size)
+		for threads := 1; threads <= maxThreads; threads++ {
+			dst := filepath.Join(dir, fmt.Sprintf("dst-%d-%d", size, threads))
+			res, err := copyFile(src, dst, threads)
+			if err != nil {
+				t.Fatalf("%d bytes, %d threads: %v", size, threads, err)
+			}
+			if res.BytesCopied != size {
+				t.Errorf("%d bytes, %d threads: copied %d bytes", size, threads, res.BytesCopied)
+			}
+			assertData(t, dst, data)
+			info, err := os.Stat(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().Perm() != 0640 {
+				t.Errorf("%d bytes, %d threads: mode %v, want 0640", size, threads, info.Mode().Perm())
+			}
+		}
+	}
+}
+
+func TestSmallFileSingleThread(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	maps := recordMaps(t)
+
+	// Below -stream-below nothing is mapped
+	src := filepath.Join(dir, "small")
+	data := writeRandom(t, src, *streamBelow-1)
+	if _, err := copyFile(src, filepath.Join(dir, "small.copy"), 8); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, filepath.Join(dir, "small.copy"), data)
+	if m := maps(); len(m) != 0 {
+		t.Fatalf("streamed copy mapped %d chunks", len(m))
+	}
+
+	// Below -min-chunk a single thread maps the whole file
+	src = filepath.Join(dir, "medium")
+	data = writeRandom(t, src, *minChunk-1)
+	if _, err := copyFile(src, filepath.Join(dir, "medium.copy"), 8); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, filepath.Join(dir, "medium.copy"), data)
+	if m := maps(); len(m) != 1 || m[0] != (chunk{0, *minChunk - 1}) {
+		t.Fatalf("got source maps %v, want one of the whole file", m)
+	}
+}
+
+func TestCopyTooLargeToMap(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "stream-below", "1")
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		size, limit int64
+	}{
+		{pageSize + 5, pageSize},
+		{2*pageSize - 1, pageSize},
+		{4<<20 + 5, 64 << 10},
+	} {
+		// Mappings larger than the limit run out of address space
+		var largest int64
+		var lock sync.Mutex
+		setMmap(t, func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+			if int64(length) > tc.limit {
+				return nil, unix.ENOMEM
+			}
+			lock.Lock()
+			if int64(length) > largest {
+				largest = int64(length)
+			}
+			lock.Unlock()
+			return unix.Mmap(fd, offset, length, prot, flags)
+		})
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", tc.size))
+		dst := src + ".copy"
+		data := writeRandom(t, src, tc.size)
+		if _, err := copyFile(src, dst, 1); err != nil {
+			t.Fatalf("%d bytes: %v", tc.size, err)
+		}
+		assertData(t, dst, data)
+		if largest == 0 || largest > tc.limit {
+			t.Errorf("%d bytes: largest mapping %d, limit %d", tc.size, largest, tc.limit)
+		}
+	}
+}
+
+func TestConfirm(t *testing.T) {
+	in, out := promptIn, promptOut
+	t.Cleanup(func() { promptIn, promptOut = in, out })
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	data := writeRandom(t, src, 100)
+	old := writeRandom(t, dst, 200)
+
+	for _, tc := range []struct {
+		answer string
+		want   bool
+	}{
+		{"y\n", true},
+		{"Y\n", true},
+		{"n\n", false},
+		{"yes\n", false},
+		{"", false},
+	} {
+		var out bytes.Buffer
+		promptIn, promptOut = strings.NewReader(tc.answer), &out
+		if got := confirm(dst); got != tc.want {
+			t.Errorf("answer %q: got %v, want %v", tc.answer, got, tc.want)
+		}
+		if !strings.Contains(out.String(), dst) {
+			t.Errorf("prompt %q doesn't name the destination", out.String())
+		}
+	}
+
+	// Declining leaves the destination alone
+	promptIn, promptOut = strings.NewReader("n\n"), new(bytes.Buffer)
+	if _, err := copyFile(src, dst, 1); !errors.Is(err, errNotOverwritten) {
+		t.Fatalf("declined copy returned %v", err)
+	}
+	assertData(t, dst, old)
+	promptIn = strings.NewReader("y\n")
+	if _, err := copyFile(src, dst, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+}
+
+func TestPrivateSourceMapping(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	srcMapFlags = unix.MAP_PRIVATE
+	t.Cleanup(func() { srcMapFlags = unix.MAP_SHARED })
+	var lock sync.Mutex
+	var srcFlags, dstFlags []int
+	setMmap(t, func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+		lock.Lock()
+		if prot == unix.PROT_READ {
+			srcFlags = append(srcFlags, flags)
+		} else {
+			dstFlags = append(dstFlags, flags)
+		}
+		lock.Unlock()
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	data := writeRandom(t, src, 1<<20+7)
+	if _, err := copyFile(src, dst, 4); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+	if len(srcFlags) == 0 || len(dstFlags) == 0 {
+		t.Fatal("nothing was mapped")
+	}
+	for _, f := range srcFlags {
+		if f&unix.MAP_PRIVATE == 0 {
+			t.Errorf("source mapped with flags %#x, want MAP_PRIVATE", f)
+		}
+	}
+	// Writes to private mappings never reach the file
+	for _, f := range dstFlags {
+		if f&unix.MAP_SHARED == 0 {
+			t.Errorf("destination mapped with flags %#x, want MAP_SHARED", f)
+		}
+	}
+}
+
+func TestChunkCoverage(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	maps := recordMaps(t)
+	dir := t.TempDir()
+	for _, size := range []int64{*streamBelow, 17*pageSize + 1, 1<<20 - 1, 3<<20 + pageSize/2} {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", size))
+		data := writeRandom(t, src, size)
+		for threads := 1; threads <= 16; threads++ {
+			dst := fmt.Sprintf("%s-%d.copy", src, threads)
+			if _, err := copyFile(src, dst, threads); err != nil {
+				t.Fatal(err)
+			}
+			assertData(t, dst, data)
+			// The ranges mapped by the threads cover the source exactly once
+			var next int64
+			for _, m := range maps() {
+				if m.Offset != next {
+					t.Fatalf("%d bytes, %d threads: range at %d, want %d", size, threads, m.Offset, next)
+				}
+				next += m.Size
+			}
+			if next != size {
+				t.Errorf("%d bytes, %d threads: ranges end at %d", size, threads, next)
+			}
+		}
+	}
+}
+
+func TestSizeMismatch(t *testing.T) {
+	setFlag(t, "f", "true")
+	// Another process grows the destination while it is copied
+	setMmap(t, func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+		if prot&unix.PROT_WRITE != 0 {
+			if err := unix.Ftruncate(fd, 1<<20+pageSize); err != nil {
+				return nil, err
+			}
+		}
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 1<<20)
+	_, err := copyFile(src, filepath.Join(dir, "dst"), 1)
+	if err == nil || !strings.Contains(err.Error(), "size mismatch") {
+		t.Fatalf("got %v, want a size mismatch", err)
+	}
+}
+
+func TestOverwriteLarger(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	for _, size := range []int64{100, *streamBelow + 1, 1<<20 + 1} {
+		for _, method := range []string{"mmap", "pread"} {
+			setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+			src := filepath.Join(dir, fmt.Sprintf("src-%d", size))
+			data := writeRandom(t, src, size)
+			dst := fmt.Sprintf("%s-%s.copy", src, method)
+			writeRandom(t, dst, 3*size)
+			if _, err := copyFile(src, dst, 2); err != nil {
+				t.Fatal(err)
+			}
+			assertData(t, dst, data)
+		}
+	}
+}
+
+func TestPipeSource(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	fifo := filepath.Join(dir, "fifo")
+	if err := unix.Mkfifo(fifo, 0600); err != nil {
+		t.Skip("can't create a named pipe:", err)
+	}
+	data := make([]byte, 1<<20+3)
+	rand.New(rand.NewSource(3)).Read(data)
+	errs := make(chan error, 1)
+	go func() {
+		w, err := os.OpenFile(fifo, os.O_WRONLY, 0)
+		if err == nil {
+			_, err = w.Write(data)
+			w.Close()
+		}
+		errs <- err
+	}()
+	dst := filepath.Join(dir, "dst")
+	res, err := copyFile(fifo, dst, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if res.BytesCopied != int64(len(data)) {
+		t.Errorf("copied %d bytes, want %d", res.BytesCopied, len(data))
+	}
+	assertData(t, dst, data)
+}
+
+func TestFirstFailureStopsThreads(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	// The first chunk fails to map, the others wait for the failure
+	failed := make(chan struct{})
+	setMmap(t, func(fd int, offset int64, length int, prot int, flags int) ([]byte, error) {
+		if prot == unix.PROT_READ && offset == 0 {
+			close(failed)
+			return nil, unix.EIO
+		}
+		<-failed
+		time.Sleep(10 * time.Millisecond)
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 8<<20)
+	done := progress.done.Load()
+	_, err := copyFile(src, filepath.Join(dir, "dst"), 8)
+	if !errors.Is(err, unix.EIO) {
+		t.Fatalf("got %v, want EIO", err)
+	}
+	// Threads check for failures before copying each window
+	if n := progress.done.Load() - done; n != 0 {
+		t.Errorf("%d bytes copied after the first chunk failed", n)
+	}
+}
+
+func TestSyncData(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	var lock sync.Mutex
+	var synced []int
+	msyncFunc = func(b []byte, flags int) error {
+		lock.Lock()
+		synced = append(synced, len(b))
+		lock.Unlock()
+		return unix.Msync(b, flags)
+	}
+	t.Cleanup(func() { msyncFunc = unix.Msync })
+	maps := recordMaps(t)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 1<<20+3)
+
+	for _, syncData := range []bool{false, true} {
+		setFlag(t, "sync-data", strconv.FormatBool(syncData))
+		synced = nil
+		if _, err := copyFile(src, filepath.Join(dir, "dst"), 4); err != nil {
+			t.Fatal(err)
+		}
+		chunks := maps()
+		if !syncData {
+			if len(synced) != 0 {
+				t.Errorf("synced %d chunks without -sync-data", len(synced))
+			}
+			continue
+		}
+		// Each mapped chunk is synced once, all of the data in total
+		if len(synced) != len(chunks) {
+			t.Errorf("synced %d chunks of %d", len(synced), len(chunks))
+		}
+		var total int
+		for _, n := range synced {
+			total += n
+		}
+		if total != 1<<20+3 {
+			t.Errorf("synced %d bytes, want %d", total, 1<<20+3)
+		}
+	}
+}
+
+func TestCopyMethod(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	small := filepath.Join(dir, "small")
+	writeRandom(t, small, 100)
+	large := filepath.Join(dir, "large")
+	writeRandom(t, large, *streamBelow)
+	for _, tc := range []struct {
+		source string
+		flag   string
+		value  string
+		want   string
+	}{
+		{small, "no-mmap", "false", "stream"},
+		{large, "no-mmap", "false", "mmap"},
+		{large, "no-mmap", "true", "pread"},
+		{large, "metadata-only", "true", "metadata-only"},
+		{large, "compress", "gzip", "gzip"},
+	} {
+		setFlag(t, tc.flag, tc.value)
+		res, err := copyFile(tc.source, filepath.Join(dir, "dst"), 2)
+		if err != nil {
+			t.Fatalf("-%s=%s: %v", tc.flag, tc.value, err)
+		}
+		if res.Method != tc.want {
+			t.Errorf("-%s=%s: method %s, want %s", tc.flag, tc.value, res.Method, tc.want)
+		}
+		setFlag(t, tc.flag, flag.Lookup(tc.flag).DefValue)
+	}
+}
+
+func TestReflinkFallback(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeRandom(t, src, 1<<20)
+	dst := filepath.Join(dir, "dst")
+
+	// Filesystems without reflinks fail -cow-only, the same as -reflink=always
+	setFlag(t, "cow-only", "true")
+	if _, err := copyFile(src, dst, 2); err == nil {
+		if err = cloneFile(mustOpen(t, src), mustOpen(t, dst)); err == nil {
+			t.Skip("the filesystem of the test supports reflinks")
+		}
+		t.Fatal("-cow-only copied the data of a source it can't clone")
+	}
+	setFlag(t, "cow-only", "false")
+
+	// and fall back to copying the data with -reflink=auto
+	setFlag(t, "reflink", "auto")
+	res, err := copyFile(src, dst, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+	if res.Method != "mmap" {
+		t.Errorf("method %s, want mmap", res.Method)
+	}
+}
+
+// Replace FICLONE, for the duration of a test, with a copy that behaves
+// like it: the destination never shrinks, and a source that doesn't end
+// on a block boundary can only be cloned to the end of the destination
+func setFakeClone(t *testing.T) {
+	cloneFunc = func(src, dst *os.File) error {
+		srcInfo, err := src.Stat()
+		if err != nil {
+			return err
+		}
+		dstInfo, err := dst.Stat()
+		if err != nil {
+			return err
+		}
+		if srcInfo.Size()%4096 != 0 && dstInfo.Size() > srcInfo.Size() {
+			return unix.EINVAL
+		}
+		data, err := os.ReadFile(src.Name())
+		if err == nil {
+			_, err = dst.WriteAt(data, 0)
+		}
+		return err
+	}
+	t.Cleanup(func() { cloneFunc = cloneFile })
+}
+
+func TestCloneOverLarger(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFakeClone(t)
+	dir := t.TempDir()
+	for _, tc := range []struct{ flag, value string }{{"cow-only", "true"}, {"reflink", "auto"}} {
+		setFlag(t, tc.flag, tc.value)
+		// The last block of a source of this size is partial
+		for _, size := range []int64{64 << 10, 64<<10 + 100} {
+			src := filepath.Join(dir, "src")
+			data := writeRandom(t, src, size)
+			dst := filepath.Join(dir, "dst")
+			writeRandom(t, dst, 4*size)
+			res, err := copyFile(src, dst, 2)
+			if err != nil {
+				t.Fatalf("-%s=%s, %d bytes: %v", tc.flag, tc.value, size, err)
+			}
+			assertData(t, dst, data)
+			// and -reflink=auto doesn't fall back to copying the data
+			if res.Method != "clone" {
+				t.Errorf("-%s=%s, %d bytes: method %s, want clone", tc.flag, tc.value, size, res.Method)
+			}
+		}
+		setFlag(t, tc.flag, flag.Lookup(tc.flag).DefValue)
+	}
+}
+
+// Open a file for reading and writing, closed at the end of the test
+func mustOpen(t *testing.T, path string) *os.File {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	return f
+}
+
+func TestDestinationSymlink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeRandom(t, src, 100000)
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	reset := func() []byte {
+		old := writeRandom(t, target, 5000)
+		os.Remove(link)
+		if err := os.Symlink("target", link); err != nil {
+			t.Fatal(err)
+		}
+		return old
+	}
+	isLink := func() bool {
+		info, err := os.Lstat(link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.Mode()&os.ModeSymlink != 0
+	}
+
+	// Without -no-dereference-dest the target is overwritten
+	setFlag(t, "f", "true")
+	reset()
+	if _, err := copyFile(src, link, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, target, data)
+	if !isLink() {
+		t.Error("the destination symlink was replaced")
+	}
+
+	// and with it the link is replaced, also by staged copies
+	setFlag(t, "no-dereference-dest", "true")
+	for _, atomic := range []string{"false", "true"} {
+		setFlag(t, "atomic", atomic)
+		old := reset()
+		if _, err := copyFile(src, link, 2); err != nil {
+			t.Fatalf("-atomic=%s: %v", atomic, err)
+		}
+		assertData(t, link, data)
+		assertData(t, target, old)
+		if isLink() {
+			t.Errorf("-atomic=%s: the destination is still a symlink", atomic)
+		}
+	}
+
+	// -n refuses both
+	setFlag(t, "f", "false")
+	setFlag(t, "n", "true")
+	setFlag(t, "atomic", "false")
+	for _, noDeref := range []string{"false", "true"} {
+		setFlag(t, "no-dereference-dest", noDeref)
+		old := reset()
+		if _, err := copyFile(src, link, 2); !errors.Is(err, errNotOverwritten) {
+			t.Fatalf("-no-dereference-dest=%s: got %v, want %v", noDeref, err, errNotOverwritten)
+		}
+		assertData(t, target, old)
+		if !isLink() {
+			t.Errorf("-no-dereference-dest=%s: the destination symlink was replaced", noDeref)
+		}
+	}
+}
+
+func TestTouchDest(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "touch-dest", "true")
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	stderr := os.Stderr
+	os.Stderr = w
+	t.Cleanup(func() { os.Stderr = stderr })
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeRandom(t, src, 1<<20)
+	dst := filepath.Join(dir, "dst")
+	// The placeholder is announced and at full size before any data is mapped
+	var announced string
+	setMmap(t, func(fd int, offset int64, length, prot, flags int) ([]byte, error) {
+		if announced == "" {
+			w.Close()
+			b, _ := io.ReadAll(r)
+			announced = string(b)
+			if info, err := os.Stat(dst); err != nil || info.Size() != int64(len(data)) {
+				t.Errorf("destination at the first mapping: %v, %v", info, err)
+			}
+		}
+		return unix.Mmap(fd, offset, length, prot, flags)
+	})
+	if _, err := copyFile(src, dst, 1); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+	if want := fmt.Sprintf("%s: created with %d bytes\n", dst, len(data)); announced != want {
+		t.Errorf("announced %q, want %q", announced, want)
+	}
+}
+
+func TestSyncRange(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sync-data", "true")
+	setFlag(t, "sync-range", "true")
+	var msyncs atomic.Int64
+	msyncFunc = func(b []byte, flags int) error {
+		msyncs.Add(1)
+		return unix.Msync(b, flags)
+	}
+	t.Cleanup(func() { msyncFunc = unix.Msync })
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeRandom(t, src, 1<<20+3)
+	for _, method := range []string{"mmap", "pread"} {
+		setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+		dst := filepath.Join(dir, method)
+		if _, err := copyFile(src, dst, 3); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		assertData(t, dst, data)
+	}
+	// Chunks are flushed with sync_file_range where there is one
+	if n := msyncs.Load(); runtime.GOOS == "linux" && n != 0 {
+		t.Errorf("%d chunks synced with msync", n)
+	}
+}
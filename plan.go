@@ -0,0 +1,109 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// How a copy would be done, computed without touching the destination
+type plan struct {
+	Source      string
+	Destination string
+	Method      string // mmap, pread, stream, pipe, gzip, gunzip, metadata-only or clone
+	Threads     int
+	Size        int64   // bytes of the source, 0 when not known in advance
+	Chunks      []chunk // ranges of the source copied by each thread of mmap copies
+}
+
+// Range of the source copied by one thread
+type chunk struct {
+	Offset int64
+	Size   int64
+}
+
+func (p *plan) String() string {
+	s := fmt.Sprintf("%s -> %s: %s", p.Source, p.Destination, p.Method)
+	if p.Method == "mmap" || p.Method == "pread" {
+		s += fmt.Sprintf(", %d threads", p.Threads)
+	}
+	if p.Size > 0 {
+		s += fmt.Sprintf(", %s", formatSize(p.Size))
+	}
+	return s
+}
+
+// Compute the plan of copying source to destination with a thread budget
+func makePlan(source, destination string, threads int) (*plan, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	_, size, err := sourceSize(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &plan{Source: source, Destination: destination, Threads: 1, Size: size}
+	info, err := os.Stat(destination)
+	p.Method = copyMethod(size, info, err)
+	if p.Method == "mmap" || p.Method == "pread" {
+		p.Chunks = planChunks(size, threads)
+		p.Threads = len(p.Chunks)
+	}
+	return p, nil
+}
+
+// Name the method copyFiles uses to copy size bytes of a source to a
+// destination with the given stat result
+func copyMethod(size int64, info os.FileInfo, err error) string {
+	switch {
+	case *compress != "":
+		return "gzip"
+	case *decompress:
+		return "gunzip"
+	case err == nil && isNamedPipe(info) && !*cowOnly:
+		return "pipe"
+	case *cowOnly:
+		return "clone"
+	case *metadataOnly:
+		return "metadata-only"
+	case size == 0 || size < *streamBelow:
+		return "stream"
+	case *noMmap:
+		return "pread"
+	}
+	return "mmap"
+}
+
+// Split a source in page aligned chunks, one per thread. Files are not
+// split in chunks smaller than the minimum chunk size, as the mapping
+// overhead dominates the copy of small chunks.
+func planChunks(size int64, threads int) []chunk {
+	floor := *minChunk
+	if floor < pageSize {
+		floor = pageSize
+	}
+	if n := size / floor; int64(threads) > n {
+		threads = int(n)
+	}
+	if threads < 1 {
+		threads = 1
+	}
+	chunks := make([]chunk, threads)
+	step := align(size / int64(threads))
+	for i := range chunks {
+		chunks[i] = chunk{int64(i) * step, step}
+	}
+	// The last chunk runs to the end of the source
+	last := &chunks[threads-1]
+	last.Size = size - last.Offset
+	return chunks
+}
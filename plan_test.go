@@ -0,0 +1,60 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestPlanChunks(t *testing.T) {
+	// A small page makes the alignment of every chunk count
+	pageSize = 512
+	t.Cleanup(func() { pageSize = int64(os.Getpagesize()) })
+	setFlag(t, "min-chunk", "1024")
+
+	for size := int64(0); size < 20*pageSize; size += 97 {
+		for threads := 1; threads <= 9; threads++ {
+			chunks := planChunks(size, threads)
+			if len(chunks) < 1 || len(chunks) > threads {
+				t.Fatalf("%d bytes, %d threads: got %d chunks", size, threads, len(chunks))
+			}
+			if len(chunks) > 1 && size/int64(len(chunks)) < *minChunk {
+				t.Errorf("%d bytes, %d threads: %d chunks smaller than -min-chunk", size, threads, len(chunks))
+			}
+			var next int64
+			for i, c := range chunks {
+				if c.Offset != next {
+					t.Fatalf("%d bytes, %d threads: chunk %d at %d, want %d", size, threads, i, c.Offset, next)
+				}
+				if c.Offset%pageSize != 0 {
+					t.Errorf("%d bytes, %d threads: chunk %d at unaligned offset %d", size, threads, i, c.Offset)
+				}
+				if c.Size <= 0 && size > 0 {
+					t.Errorf("%d bytes, %d threads: empty chunk %d", size, threads, i)
+				}
+				next += c.Size
+			}
+			if next != size {
+				t.Errorf("%d bytes, %d threads: chunks end at %d", size, threads, next)
+			}
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	pageSize = 512
+	t.Cleanup(func() { pageSize = int64(os.Getpagesize()) })
+	for _, tc := range []struct{ size, want int64 }{
+		{0, 0}, {1, 0}, {511, 0}, {512, 512}, {1023, 512}, {1024, 1024},
+	} {
+		if got := align(tc.size); got != tc.want {
+			t.Errorf("align(%d) = %d, want %d", tc.size, got, tc.want)
+		}
+	}
+}
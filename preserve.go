@@ -0,0 +1,52 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Give the destination the resource fork, the permission bits and the access
+// and modification times of the source, as read in st before the copy. Times
+// are set with their full nanosecond precision, filesystems with coarser
+// timestamps round them down.
+func preserveAttrs(source string, st *unix.Stat_t, destination string) error {
+	// Setting the fork updates the times, so it goes first
+	err := copyResourceFork(source, destination)
+	if err != nil {
+		return err
+	}
+	err = unix.Chmod(destination, uint32(st.Mode)&07777)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: destination, Err: err}
+	}
+	// Best effort, filesystems without birth times ignore it
+	setBirthTime(destination, st)
+	err = unix.UtimesNanoAt(unix.AT_FDCWD, destination, []unix.Timespec{st.Atim, st.Mtim}, 0)
+	if err != nil {
+		return &os.PathError{Op: "utimensat", Path: destination, Err: err}
+	}
+	return nil
+}
+
+// Make a copied destination read only for everyone, keeping its execute bits.
+// Changing the mode leaves the data and the modification time alone.
+func makeReadOnly(destination string) error {
+	var st unix.Stat_t
+	err := unix.Stat(destination, &st)
+	if err != nil {
+		return &os.PathError{Op: "stat", Path: destination, Err: err}
+	}
+	err = unix.Chmod(destination, 0444|uint32(st.Mode)&0111)
+	if err != nil {
+		return &os.PathError{Op: "chmod", Path: destination, Err: err}
+	}
+	return nil
+}
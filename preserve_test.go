@@ -0,0 +1,53 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPreserveTimes(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "p", "true")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 1000)
+	if err := os.Chmod(src, 0751); err != nil {
+		t.Fatal(err)
+	}
+	atime := time.Date(2021, 3, 4, 5, 6, 7, 123456789, time.UTC)
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 987654321, time.UTC)
+	if err := os.Chtimes(src, atime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(mtime) {
+		t.Skipf("the filesystem keeps %v of %v", info.ModTime(), mtime)
+	}
+
+	dst := filepath.Join(dir, "dst")
+	if _, err := copyFile(src, dst, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.Stat(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.ModTime().Equal(mtime) {
+		t.Errorf("destination modified at %v, want %v", got.ModTime(), mtime)
+	}
+	if got.Mode().Perm() != 0751 {
+		t.Errorf("destination mode %v, want 0751", got.Mode().Perm())
+	}
+}
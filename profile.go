@@ -0,0 +1,48 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+)
+
+// Set the thread budget, the parallel files of a list and the read ahead
+// window from a -concurrency-profile, keeping the flags set on the command line
+func applyProfile(name string) error {
+	cpus := runtime.NumCPU()
+	var t, j int
+	var window int64
+	switch name {
+	case "io-bound":
+		// Few streams with deep read ahead, so disks don't seek between them
+		t, j, window = 4, 2, 32<<20
+	case "balanced":
+		t, j, window = cpus, 2, 8<<20
+	case "cpu-bound":
+		// Data in the page cache or on fast NVMe, the CPUs copy it
+		t, j, window = cpus, (cpus+3)/4, 0
+	default:
+		return fmt.Errorf("unknown concurrency profile %s, use io-bound, balanced or cpu-bound", name)
+	}
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	if !set["t"] {
+		*threads = t
+	}
+	if !set["j"] {
+		*fileJobs = j
+	}
+	if !set["readahead"] {
+		*readahead = window
+	}
+	return nil
+}
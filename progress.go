@@ -0,0 +1,75 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Data copied by each mapped step, so progress is counted within a chunk
+const progressStep = 8 << 20
+
+// Interval between progress records
+const progressInterval = time.Second
+
+// Progress of all copies: bytes done and the total size of the sources.
+// Sources of unknown size, like pipes, only add to the total once copied.
+var progress struct {
+	done  atomic.Int64
+	total atomic.Int64
+}
+
+// Write a "done/total" progress record to w every interval until the
+// returned function is called, which writes a last record.
+func reportProgress(w io.Writer) func() {
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				writeProgress(w)
+			case <-stop:
+				writeProgress(w)
+				return
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		<-stopped
+	}
+}
+
+// Write a progress record. With -crc it also holds the CRC32C of the data
+// copied so far and the length it covers, as "done/total crc32c length".
+func writeProgress(w io.Writer) {
+	if *showCRC {
+		crc, end := prefixCRC()
+		fmt.Fprintf(w, "%d/%d %08x %d\n", progress.done.Load(), progress.total.Load(), crc, end)
+		return
+	}
+	fmt.Fprintf(w, "%d/%d\n", progress.done.Load(), progress.total.Load())
+}
+
+// Reader that counts the data read from it as progress
+type progressReader struct {
+	io.Reader
+}
+
+func (r progressReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	progress.done.Add(int64(n))
+	return n, err
+}
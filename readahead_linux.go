@@ -0,0 +1,27 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cached pages of a file can be dropped, for -paranoid-read
+const dropCacheSupported = true
+
+// Ask the kernel to drop the clean cached pages of a range of the file
+func dropCache(f *os.File, offset, length int64) error {
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_DONTNEED)
+}
+
+// Ask the kernel to start reading a range of the file into the page cache
+func willNeed(f *os.File, offset, length int64) error {
+	return unix.Fadvise(int(f.Fd()), offset, length, unix.FADV_WILLNEED)
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const dropCacheSupported = false
+
+// Dropping cached pages is Linux only
+func dropCache(f *os.File, offset, length int64) error {
+	return unix.ENOSYS
+}
+
+// Read ahead hints are Linux only
+func willNeed(f *os.File, offset, length int64) error {
+	return unix.ENOSYS
+}
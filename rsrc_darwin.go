@@ -0,0 +1,38 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Extended attribute exposing the resource fork of a file
+const resourceForkXattr = "com.apple.ResourceFork"
+
+// Copy the resource fork of the source, if it has one, to the destination
+func copyResourceFork(source, destination string) error {
+	size, err := unix.Getxattr(source, resourceForkXattr, nil)
+	if err == unix.ENOATTR || err == unix.ENOTSUP {
+		return nil
+	}
+	if err != nil {
+		return &os.PathError{Op: "getxattr", Path: source, Err: err}
+	}
+	fork := make([]byte, size)
+	size, err = unix.Getxattr(source, resourceForkXattr, fork)
+	if err != nil {
+		return &os.PathError{Op: "getxattr", Path: source, Err: err}
+	}
+	err = unix.Setxattr(destination, resourceForkXattr, fork[:size], 0)
+	if err != nil {
+		return &os.PathError{Op: "setxattr", Path: destination, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !darwin
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+// Resource forks only exist on macOS
+func copyResourceFork(source, destination string) error {
+	return nil
+}
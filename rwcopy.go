@@ -0,0 +1,188 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Zeros standing in for the holes of sparse copies in the -crc of -no-mmap
+var zeros [1 << 20]byte
+
+// Functions used to read and write the chunks of -no-mmap copies.
+// Tests can override them to return short counts and EINTR.
+var (
+	preadFunc  = unix.Pread
+	pwriteFunc = unix.Pwrite
+)
+
+// Destination of the chunks of -no-mmap copies. Threads write their chunks
+// concurrently at any offset and sync each chunk once it is written, so
+// a backend that is not a local file, like an object store uploading the
+// chunks as the parts of a multipart upload, only needs these two calls.
+type chunkDest interface {
+	WriteAt(p []byte, offset int64) (int, error)
+	SyncChunk(offset, size int64) error
+}
+
+// Local file destination of chunks, written in place
+type localDest struct {
+	*os.File
+}
+
+// Write all of p at offset
+func (d localDest) WriteAt(p []byte, offset int64) (int, error) {
+	err := pwriteFull(int(d.Fd()), p, offset)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sync a written chunk to disk, only its range with -sync-range
+func (d localDest) SyncChunk(offset, size int64) error {
+	var err error
+	if *useSyncRange {
+		err = syncRange(d.File, offset, size)
+	}
+	if !*useSyncRange || err == unix.ENOSYS {
+		err = d.Sync()
+	}
+	return err
+}
+
+// Copy a chunk with positioned reads and writes instead of mapping it, so
+// no data is ever accessed through a mapping of the files.
+func (t *transfer) rwCopy(srcOffset, dstOffset, size int64) error {
+	out := t.out
+	if out == nil {
+		out = localDest{t.dst}
+	}
+	n := *bufferSize
+	// Delta copies compare and rewrite the data one window at a time
+	if t.delta && *compareWindow > 0 {
+		n = *compareWindow
+	}
+	if size < n {
+		n = size
+	}
+	buf := make([]byte, n)
+	var cmp []byte
+	if t.delta {
+		cmp = make([]byte, n)
+	}
+	// Holes of sparse copies are done without copying them
+	holes := size
+	next := srcOffset
+	for _, r := range t.dataRanges(srcOffset, size) {
+		holes -= r.length
+		if *showCRC && r.offset > next {
+			addCRC(next, r.offset-next, zerosCRC(r.offset-next))
+		}
+		next = r.offset + r.length
+		for off := r.offset; off < next; off += n {
+			if t.failed.Load() {
+				return nil
+			}
+			b := buf
+			if next-off < n {
+				b = buf[:next-off]
+			}
+			dst := dstOffset + off - srcOffset
+			err := preadFull(int(t.src.Fd()), b, off)
+			if err != nil {
+				return &copyError{"read", off, int64(len(b)), err}
+			}
+			if *showCRC {
+				addCRC(off, int64(len(b)), crc32.Checksum(b, castagnoli))
+			}
+			if t.delta {
+				err = preadFull(int(t.dst.Fd()), cmp[:len(b)], dst)
+				if err != nil {
+					return &copyError{"read", dst, int64(len(b)), err}
+				}
+			}
+			if !t.delta || !bytes.Equal(cmp[:len(b)], b) {
+				_, err = out.WriteAt(b, dst)
+				if err != nil {
+					return &copyError{"write", dst, int64(len(b)), err}
+				}
+				t.written.Add(int64(len(b)))
+			}
+			progress.done.Add(int64(len(b)))
+		}
+	}
+	if *showCRC && srcOffset+size > next {
+		addCRC(next, srcOffset+size-next, zerosCRC(srcOffset+size-next))
+	}
+	progress.done.Add(holes)
+	if *syncData {
+		err := out.SyncChunk(dstOffset, size)
+		if err != nil {
+			return &copyError{"sync", dstOffset, size, err}
+		}
+	}
+	return nil
+}
+
+// Read all of buf from offset, the data of the source must be there
+func preadFull(fd int, buf []byte, offset int64) error {
+	for len(buf) > 0 {
+		n, err := preadFunc(fd, buf, offset)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrUnexpectedEOF
+		}
+		buf = buf[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// Write all of buf at offset
+func pwriteFull(fd int, buf []byte, offset int64) error {
+	for len(buf) > 0 {
+		n, err := pwriteFunc(fd, buf, offset)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+		offset += int64(n)
+	}
+	return nil
+}
+
+// CRC32C of length zero bytes
+func zerosCRC(length int64) uint32 {
+	var crc uint32
+	for length > 0 {
+		n := int64(len(zeros))
+		if length < n {
+			n = length
+		}
+		crc = crc32.Update(crc, castagnoli, zeros[:n])
+		length -= n
+	}
+	return crc
+}
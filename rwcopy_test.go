@@ -0,0 +1,138 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Make reads and writes transfer at most limit bytes, and every third
+// call fail with EINTR, for the duration of a test
+func setPartialIO(t *testing.T, limit int) {
+	var calls atomic.Int64
+	partial := func(fn func(int, []byte, int64) (int, error)) func(int, []byte, int64) (int, error) {
+		return func(fd int, p []byte, offset int64) (int, error) {
+			if calls.Add(1)%3 == 0 {
+				return 0, unix.EINTR
+			}
+			if len(p) > limit {
+				p = p[:limit]
+			}
+			return fn(fd, p, offset)
+		}
+	}
+	preadFunc, pwriteFunc = partial(unix.Pread), partial(unix.Pwrite)
+	t.Cleanup(func() { preadFunc, pwriteFunc = unix.Pread, unix.Pwrite })
+}
+
+func TestPartialReadsAndWrites(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "no-mmap", "true")
+	setFlag(t, "buffer-size", "64K")
+	setPartialIO(t, 1000)
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	data := writeRandom(t, src, 1<<20+5)
+	if _, err := copyFile(src, dst, 3); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+
+	// Delta copies also read the destination
+	f, err := os.OpenFile(dst, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte("changed"), 500000)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "delta", "true")
+	if _, err := copyFile(src, dst, 3); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+}
+
+func TestWriteNothing(t *testing.T) {
+	pwriteFunc = func(fd int, p []byte, offset int64) (int, error) { return 0, nil }
+	t.Cleanup(func() { pwriteFunc = unix.Pwrite })
+	f, err := os.Create(filepath.Join(t.TempDir(), "dst"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := pwriteFull(int(f.Fd()), []byte("data"), 0); !errors.Is(err, io.ErrShortWrite) {
+		t.Fatalf("got %v, want %v", err, io.ErrShortWrite)
+	}
+}
+
+// Chunk destination kept in memory, like a backend that is not a file
+type memDest struct {
+	lock  sync.Mutex
+	data  []byte
+	syncs []extent
+}
+
+func (d *memDest) WriteAt(p []byte, offset int64) (int, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return copy(d.data[offset:], p), nil
+}
+
+func (d *memDest) SyncChunk(offset, size int64) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.syncs = append(d.syncs, extent{offset, size})
+	return nil
+}
+
+func TestChunkDest(t *testing.T) {
+	setFlag(t, "sync-data", "true")
+	setFlag(t, "buffer-size", "64K")
+	src := filepath.Join(t.TempDir(), "src")
+	data := writeRandom(t, src, 1<<20+5)
+	f, err := os.Open(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	out := &memDest{data: make([]byte, len(data))}
+	chunks := planChunks(int64(len(data)), 3)
+	tr := &transfer{src: f, out: out, errs: make(chan error, len(chunks))}
+	for _, c := range chunks {
+		tr.wg.Add(1)
+		go func(c chunk) {
+			defer tr.wg.Done()
+			if err := tr.rwCopy(c.Offset, c.Offset, c.Size); err != nil {
+				tr.fail(err)
+			}
+		}(c)
+	}
+	tr.wg.Wait()
+	close(tr.errs)
+	if err := <-tr.errs; err != nil {
+		t.Fatal(err)
+	}
+	if i := firstDiff(out.data, data); i >= 0 {
+		t.Fatalf("destination differs at offset %d", i)
+	}
+	if len(out.syncs) != len(chunks) {
+		t.Errorf("%d chunks synced, want %d", len(out.syncs), len(chunks))
+	}
+}
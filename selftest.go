@@ -0,0 +1,177 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"text/tabwriter"
+)
+
+// Permissions of the self test sources, checked on every copy
+const selftestMode = 0640
+
+// A copy method checked by the self test, it copies source to destination
+type selftestMethod struct {
+	name string
+	copy func(source, destination string) error
+}
+
+var selftestMethods = []selftestMethod{
+	{"mmap", func(source, destination string) error {
+		return withSizes(0, pageSize, func() error {
+			_, _, err := pcopy(source, destination, runtime.NumCPU())
+			return err
+		})
+	}},
+	{"pread", func(source, destination string) error {
+		*noMmap = true
+		defer func() { *noMmap = false }()
+		return withSizes(0, pageSize, func() error {
+			_, _, err := pcopy(source, destination, runtime.NumCPU())
+			return err
+		})
+	}},
+	{"stream", func(source, destination string) error {
+		return withSizes(math.MaxInt64, pageSize, func() error {
+			_, _, err := pcopy(source, destination, 1)
+			return err
+		})
+	}},
+	{"sparse", func(source, destination string) error {
+		*sparse = "always"
+		defer func() { *sparse = "" }()
+		return withSizes(0, pageSize, func() error {
+			_, _, err := pcopy(source, destination, runtime.NumCPU())
+			return err
+		})
+	}},
+	{"gzip", func(source, destination string) error {
+		compressed := destination + ".gz"
+		defer os.Remove(compressed)
+		*compress = "gzip"
+		_, err := zcopy(source, compressed)
+		*compress = ""
+		if err != nil {
+			return err
+		}
+		*decompress = true
+		_, err = zcopy(compressed, destination)
+		*decompress = false
+		return err
+	}},
+}
+
+// Copy files of various sizes with every method and check the results
+func selftest(args []string) error {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		return fmt.Errorf("Usage %s selftest directory", os.Args[0])
+	}
+	dir := flags.Arg(0)
+
+	// Empty, sub page, unaligned, streamed and multi chunk sizes
+	sizes := []int64{0, 1, pageSize - 1, pageSize + 1, 64<<10 - 1, 1<<20 + 3, 9<<20 + 7}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "METHOD\tSIZE\tRESULT")
+	var checks, failed int
+	for _, size := range sizes {
+		source, err := selftestFile(dir, size)
+		if err != nil {
+			return err
+		}
+		destination := source + ".copy"
+		for _, m := range selftestMethods {
+			os.Remove(destination)
+			result := "pass"
+			err = m.copy(source, destination)
+			if err == nil {
+				err = selftestCheck(source, destination)
+			}
+			if err != nil {
+				result = "FAIL: " + err.Error()
+				failed++
+			}
+			checks++
+			fmt.Fprintf(w, "%s\t%d\t%s\n", m.name, size, result)
+		}
+		os.Remove(destination)
+		os.Remove(source)
+	}
+	err := w.Flush()
+	if err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d checks failed", failed, checks)
+	}
+	return err
+}
+
+// Run a copy with the given -stream-below and -min-chunk sizes
+func withSizes(stream, chunk int64, copy func() error) error {
+	oldStream, oldChunk := *streamBelow, *minChunk
+	*streamBelow, *minChunk = stream, chunk
+	defer func() { *streamBelow, *minChunk = oldStream, oldChunk }()
+	return copy()
+}
+
+// Create a test file with a hole in its first half and random data after it
+func selftestFile(dir string, size int64) (string, error) {
+	f, err := os.CreateTemp(dir, "pcp-selftest-")
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, size-size/2)
+	_, err = rand.Read(buf)
+	if err == nil {
+		_, err = f.WriteAt(buf, size/2)
+	}
+	if err == nil {
+		err = f.Chmod(selftestMode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return filepath.Clean(f.Name()), nil
+}
+
+// Check that a copy has the data and permissions of its source
+func selftestCheck(source, destination string) error {
+	want, err := os.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	got, err := os.ReadFile(destination)
+	if err != nil {
+		return err
+	}
+	if len(got) != len(want) {
+		return fmt.Errorf("size %d, expected %d", len(got), len(want))
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("data differs from the source")
+	}
+	stat, err := os.Stat(destination)
+	if err != nil {
+		return err
+	}
+	if stat.Mode().Perm() != selftestMode {
+		return fmt.Errorf("mode %v, expected %v", stat.Mode().Perm(), os.FileMode(selftestMode))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Byte size flag that accepts K, M, G and T binary suffixes
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(value string) error {
+	size, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(size)
+	return nil
+}
+
+// Define a byte size command line flag
+func flagSize(name string, value int64, usage string) *int64 {
+	s := sizeFlag(value)
+	flag.Var(&s, name, usage)
+	return (*int64)(&s)
+}
+
+// Parse a size like 4096, 64K or 1G
+func parseSize(value string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(value))
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	var shift uint
+	if n := len(v); n > 0 {
+		switch v[n-1] {
+		case 'K':
+			shift = 10
+		case 'M':
+			shift = 20
+		case 'G':
+			shift = 30
+		case 'T':
+			shift = 40
+		}
+		if shift > 0 {
+			v = v[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+	if size > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size %q is too large", value)
+	}
+	return size << shift, nil
+}
+
+// Format a byte count, with binary units when -human-readable is set
+func formatSize(size int64) string {
+	if !*humanReadable {
+		return strconv.FormatInt(size, 10) + " bytes"
+	}
+	return humanSize(size)
+}
+
+// Format a byte count like 512 B, 1.5 KiB or 3.2 GiB
+func humanSize(size int64) string {
+	const units = "KMGTPE"
+	if size < 1<<10 && size > -1<<10 {
+		return fmt.Sprintf("%d B", size)
+	}
+	value := float64(size)
+	i := -1
+	for value >= 1<<10 || value <= -1<<10 {
+		value /= 1 << 10
+		i++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, units[i])
+}
@@ -0,0 +1,45 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		want  int64
+	}{
+		{"0", 0},
+		{"4096", 4096},
+		{"64K", 64 << 10},
+		{"64k", 64 << 10},
+		{"64KB", 64 << 10},
+		{"64KiB", 64 << 10},
+		{" 4M ", 4 << 20},
+		{"1G", 1 << 30},
+		{"2T", 2 << 40},
+		{"100B", 100},
+		{"9223372036854775807", math.MaxInt64},
+		{"8388607T", 8388607 << 40},
+	} {
+		got, err := parseSize(tc.value)
+		if err != nil {
+			t.Errorf("parseSize(%q): %v", tc.value, err)
+		} else if got != tc.want {
+			t.Errorf("parseSize(%q) = %d, want %d", tc.value, got, tc.want)
+		}
+	}
+	for _, value := range []string{"", "K", "-1", "1.5G", "12X", "1P", "9223372036854775808", "8388608T", "9000000000T"} {
+		if got, err := parseSize(value); err == nil {
+			t.Errorf("parseSize(%q) = %d, want an error", value, got)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Value of -sparse: "" when off, "always" for a bare -sparse, or "auto" to
+// only look for the extents of sources with fewer blocks than their size
+type sparseFlag string
+
+func (s *sparseFlag) String() string {
+	return string(*s)
+}
+
+func (s *sparseFlag) Set(value string) error {
+	switch value {
+	case "true", "always":
+		*s = "always"
+	case "false", "never":
+		*s = ""
+	case "auto":
+		*s = "auto"
+	default:
+		return fmt.Errorf("invalid sparse mode %q", value)
+	}
+	return nil
+}
+
+// A bare -sparse means always
+func (s *sparseFlag) IsBoolFlag() bool {
+	return true
+}
+
+// Define the sparse mode command line flag
+func flagSparse(name, usage string) *sparseFlag {
+	var s sparseFlag
+	flag.Var(&s, name, usage)
+	return &s
+}
+
+// Range of file data
+type extent struct {
+	offset int64
+	length int64
+}
+
+// Add an extent clipped to the file size, merging it with the previous one if adjacent
+func addExtent(extents []extent, offset, length, size int64) []extent {
+	if offset+length > size {
+		length = size - offset
+	}
+	if length <= 0 {
+		return extents
+	}
+	if n := len(extents); n > 0 && extents[n-1].offset+extents[n-1].length == offset {
+		extents[n-1].length += length
+		return extents
+	}
+	return append(extents, extent{offset, length})
+}
+
+// Check if fewer blocks are allocated to a file than its size takes, which
+// means some of it is holes. Errors count as holes, to look at the extents.
+func hasHoles(f *os.File, size int64) bool {
+	var st unix.Stat_t
+	if unix.Fstat(int(f.Fd()), &st) != nil {
+		return true
+	}
+	return int64(st.Blocks)*512 < size
+}
+
+// Bytes of the source written to the destination, only its data extents
+// with -sparse, unless -preallocate-mode=full also allocates the holes
+func dataSize(src *os.File, info os.FileInfo, size int64) int64 {
+	if *sparse == "" || *preallocMode == "full" || !info.Mode().IsRegular() {
+		return size
+	}
+	extents, err := dataExtents(src, size)
+	if err != nil {
+		return size
+	}
+	var n int64
+	for _, e := range extents {
+		n += e.length
+	}
+	return n
+}
+
+// Function used to check that the extended destination kept its holes.
+// Tests can override it to check copies to filesystems without holes.
+var dstHolesFunc = hasHoles
+
+// Function used to punch holes in the destination.
+// Tests can override it to check the copy on filesystems that can't.
+var punchFunc = punchHole
+
+// Punch the holes of a source with the given data extents into the
+// destination at dstOffset, so it keeps no data where the source has none
+func punchSourceHoles(dst *os.File, extents []extent, dstOffset, size int64) error {
+	// Cached pages of the old data can be larger than a page and straddle
+	// a hole, and writing the data next to the hole through a mapping then
+	// allocates the hole again. Write them back and drop them first, the
+	// drop is only a hint.
+	err := dst.Sync()
+	if err != nil {
+		return err
+	}
+	dropCache(dst, dstOffset, size)
+	var next int64
+	for _, e := range extents {
+		if e.offset > next {
+			err := punchFunc(dst, dstOffset+next, e.offset-next)
+			if err != nil {
+				return err
+			}
+		}
+		next = e.offset + e.length
+	}
+	if size > next {
+		return punchFunc(dst, dstOffset+next, size-next)
+	}
+	return nil
+}
+
+// Get the parts of the source range [offset, offset+size) that hold data.
+// Copies that aren't sparse treat the whole range as data.
+func (t *transfer) dataRanges(offset, size int64) []extent {
+	if !t.sparse {
+		return []extent{{offset, size}}
+	}
+	var ranges []extent
+	for _, e := range t.extents {
+		start, end := e.offset, e.offset+e.length
+		if start < offset {
+			start = offset
+		}
+		if end > offset+size {
+			end = offset + size
+		}
+		if start < end {
+			ranges = append(ranges, extent{start, end - start})
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,117 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// FIEMAP ioctl definitions from linux/fiemap.h
+const (
+	fsIocFiemap           = 0xc020660b
+	fiemapFlagSync        = 0x1
+	fiemapExtentLast      = 0x1
+	fiemapExtentUnwritten = 0x800
+	fiemapBatch           = 256
+)
+
+type fiemapExtent struct {
+	logical    uint64
+	physical   uint64
+	length     uint64
+	reserved64 [2]uint64
+	flags      uint32
+	reserved   [3]uint32
+}
+
+type fiemap struct {
+	start         uint64
+	length        uint64
+	flags         uint32
+	mappedExtents uint32
+	extentCount   uint32
+	reserved      uint32
+	extents       [fiemapBatch]fiemapExtent
+}
+
+// Get the data extents of a file. The extent map is read with FIEMAP,
+// with a fallback to SEEK_DATA and SEEK_HOLE on filesystems without it.
+func dataExtents(f *os.File, size int64) ([]extent, error) {
+	extents, err := fiemapExtents(f, size)
+	if err == nil {
+		return extents, nil
+	}
+	return seekExtents(f, size)
+}
+
+// Read the extent map of a file with the FIEMAP ioctl. Preallocated but
+// unwritten extents read as zeros and are left out like holes.
+func fiemapExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	err := fiemapEach(f, size, func(e *fiemapExtent) {
+		if e.flags&fiemapExtentUnwritten == 0 {
+			extents = addExtent(extents, int64(e.logical), int64(e.length), size)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
+
+// Call fn with each extent of the first size bytes of a file in the
+// FIEMAP extent map, in file order, a batch of extents at a time
+func fiemapEach(f *os.File, size int64, fn func(e *fiemapExtent)) error {
+	fm := new(fiemap)
+	var start uint64
+	for start < uint64(size) {
+		*fm = fiemap{start: start, length: uint64(size) - start, flags: fiemapFlagSync, extentCount: fiemapBatch}
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(fm)))
+		if errno != 0 {
+			return errno
+		}
+		if fm.mappedExtents == 0 {
+			break
+		}
+		for i := range fm.extents[:fm.mappedExtents] {
+			e := &fm.extents[i]
+			fn(e)
+			start = e.logical + e.length
+			if e.flags&fiemapExtentLast != 0 {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Find the data extents of a file with SEEK_DATA and SEEK_HOLE
+func seekExtents(f *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	fd := int(f.Fd())
+	for offset := int64(0); offset < size; {
+		data, err := unix.Seek(fd, offset, unix.SEEK_DATA)
+		if err == unix.ENXIO {
+			break
+		}
+		if err != nil {
+			// Holes are not supported, all of the file is data
+			return []extent{{0, size}}, nil
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return nil, err
+		}
+		extents = addExtent(extents, data, hole-data, size)
+		offset = hole
+	}
+	return extents, nil
+}
@@ -0,0 +1,208 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// Write a file of size bytes with random data in the given extents and
+// holes elsewhere, and return its data. Skips the test when the
+// filesystem of path doesn't keep the holes.
+func writeSparse(t *testing.T, path string, size int64, extents []extent) []byte {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err = f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, size)
+	r := rand.New(rand.NewSource(size))
+	for _, e := range extents {
+		r.Read(data[e.offset : e.offset+e.length])
+		if _, err = f.WriteAt(data[e.offset:e.offset+e.length], e.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if got := fileExtents(t, path); !reflect.DeepEqual(got, extents) {
+		t.Skipf("the filesystem of %s keeps extents %v of %v", path, got, extents)
+	}
+	return data
+}
+
+// Data extents of the file at path
+func fileExtents(t *testing.T, path string) []extent {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extents, err := dataExtents(f, info.Size())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return extents
+}
+
+func TestAddExtent(t *testing.T) {
+	var extents []extent
+	extents = addExtent(extents, 0, 10, 100)
+	extents = addExtent(extents, 10, 10, 100) // adjacent, merged
+	extents = addExtent(extents, 50, 10, 100)
+	extents = addExtent(extents, 90, 20, 100) // clipped to the size
+	extents = addExtent(extents, 100, 10, 100)
+	want := []extent{{0, 20}, {50, 10}, {90, 10}}
+	if !reflect.DeepEqual(extents, want) {
+		t.Fatalf("got %v, want %v", extents, want)
+	}
+}
+
+func TestSparseCopy(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sparse", "always")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	dir := t.TempDir()
+	const block = 64 << 10
+	for _, tc := range []struct {
+		name    string
+		size    int64
+		extents []extent
+	}{
+		{"middle", 8 * block, []extent{{2 * block, block}, {5 * block, 2 * block}}},
+		{"leading", 4 * block, []extent{{3 * block, block}}},
+		{"trailing", 4*block + 100, []extent{{0, block}}},
+		{"empty", 4 * block, nil},
+	} {
+		src := filepath.Join(dir, tc.name)
+		data := writeSparse(t, src, tc.size, tc.extents)
+		for _, method := range []string{"mmap", "pread"} {
+			setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+			dst := src + "." + method
+			if _, err := copyFile(src, dst, 3); err != nil {
+				t.Fatalf("%s, %s: %v", tc.name, method, err)
+			}
+			assertData(t, dst, data)
+			if got := fileExtents(t, dst); !reflect.DeepEqual(got, tc.extents) {
+				t.Errorf("%s, %s: destination extents %v, want %v", tc.name, method, got, tc.extents)
+			}
+		}
+	}
+}
+
+func TestPunchHoles(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sparse", "always")
+	setFlag(t, "punch-holes", "true")
+	dir := t.TempDir()
+	const block = 64 << 10
+	extents := []extent{{block, block}, {4 * block, block}}
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 6*block, extents)
+	// A fully allocated destination of the same size is updated in place
+	dst := filepath.Join(dir, "dst")
+	writeRandom(t, dst, 6*block)
+	if _, err := copyFile(src, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	assertData(t, dst, data)
+	if got := fileExtents(t, dst); !reflect.DeepEqual(got, extents) {
+		t.Errorf("destination extents %v, want %v", got, extents)
+	}
+}
+
+func TestPunchHolesUnsupported(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sparse", "always")
+	setFlag(t, "punch-holes", "true")
+	punchFunc = func(f *os.File, offset, length int64) error {
+		return &os.PathError{Op: "fallocate", Path: f.Name(), Err: unix.EOPNOTSUPP}
+	}
+	t.Cleanup(func() { punchFunc = punchHole })
+	dir := t.TempDir()
+	const block = 64 << 10
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 4*block, []extent{{block, block}})
+	// The old data of the holes is overwritten with zeros
+	dst := filepath.Join(dir, "dst")
+	writeRandom(t, dst, 4*block)
+	for _, method := range []string{"mmap", "pread"} {
+		setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+		if _, err := copyFile(src, dst, 2); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		assertData(t, dst, data)
+	}
+}
+
+func TestSparseFreeSpace(t *testing.T) {
+	setFlag(t, "f", "true")
+	const block = 64 << 10
+	freeSpaceFunc = func(path string) (int64, error) { return 2 * block, nil }
+	t.Cleanup(func() { freeSpaceFunc = freeSpace })
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 16*block, []extent{{4 * block, block}})
+	dst := filepath.Join(dir, "dst")
+	for _, dry := range []string{"true", "false"} {
+		setFlag(t, "dry-run", dry)
+		setFlag(t, "sparse", "false")
+		if _, err := copyFile(src, dst, 2); err == nil || !strings.Contains(err.Error(), "insufficient space") {
+			t.Fatalf("-dry-run=%s: copied %d bytes into %d of space: %v", dry, 16*block, 2*block, err)
+		}
+		// Only the data of a sparse copy needs space
+		setFlag(t, "sparse", "always")
+		if _, err := copyFile(src, dst, 2); err != nil {
+			t.Fatalf("-dry-run=%s: %v", dry, err)
+		}
+	}
+	assertData(t, dst, data)
+}
+
+func TestSparseWithoutHoles(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "sparse", "always")
+	// Like FAT, which allocates and zeroes the file as it is extended
+	dstHolesFunc = func(f *os.File, size int64) bool { return false }
+	t.Cleanup(func() { dstHolesFunc = hasHoles })
+	dir := t.TempDir()
+	const block = 64 << 10
+	src := filepath.Join(dir, "src")
+	data := writeSparse(t, src, 4*block, []extent{{block, block}})
+	for _, method := range []string{"mmap", "pread"} {
+		setFlag(t, "no-mmap", strconv.FormatBool(method == "pread"))
+		dst := filepath.Join(dir, method)
+		writeRandom(t, dst, 8*block)
+		if _, err := copyFile(src, dst, 2); err != nil {
+			t.Fatalf("%s: %v", method, err)
+		}
+		assertData(t, dst, data)
+		// All of the data is written, holes included
+		if got, want := fileExtents(t, dst), []extent{{0, 4 * block}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: destination extents %v, want %v", method, got, want)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Split manifest format. After the header each line holds the name of a
+// piece, relative to the manifest, and its size:
+//
+//	# pcp split pieces 3 size 5368709120
+//	backup.img.000 2147483648
+//	backup.img.001 2147483648
+//	backup.img.002 1073741824
+const splitHeader = "# pcp split"
+
+// Suffix of the manifest written next to the pieces of a split copy
+const splitSuffix = ".split"
+
+// A piece of a split copy
+type piece struct {
+	name string
+	size int64
+}
+
+// Copy size bytes from srcOffset in src to dstOffset in dst, with the
+// chunks mapped by threads. The source offset must be page aligned.
+func copyRange(src, dst *os.File, srcOffset, dstOffset, size int64, threads int) error {
+	chunks := planChunks(size, threads)
+	t := &transfer{src: src, dst: dst, errs: make(chan error, len(chunks)), rss: rssShare(len(chunks))}
+	for _, c := range chunks {
+		t.wg.Add(1)
+		go t.mcopy(srcOffset+c.Offset, dstOffset+c.Offset, c.Size)
+	}
+	t.wg.Wait()
+	close(t.errs)
+	err := <-t.errs
+	if err == nil && *syncData && *useSyncRange {
+		err = syncRangeDone(dst)
+	}
+	return err
+}
+
+// Copy a source into destination.000, destination.001 and so on, pieces of
+// -split bytes each but the last one, and list them in destination.split.
+// Pieces are copied one after the other, each by all the threads.
+func splitCopy(source, destination string, threads int) (int64, error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+	stat, size, err := sourceSize(src)
+	if err != nil {
+		return 0, err
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("-split needs a file or block device source of a known size, %s is not", source)
+	}
+	progress.total.Add(size)
+
+	count := (size + *splitSize - 1) / *splitSize
+	width := len(strconv.FormatInt(count-1, 10))
+	if width < 3 {
+		width = 3
+	}
+	var pieces []piece
+	for i := int64(0); i < count; i++ {
+		p := piece{fmt.Sprintf("%s.%0*d", destination, width, i), *splitSize}
+		if i == count-1 {
+			p.size = size - i**splitSize
+		}
+		err = copyPiece(src, p, i**splitSize, stat.Mode().Perm(), threads)
+		if err != nil {
+			return i * *splitSize, err
+		}
+		pieces = append(pieces, p)
+	}
+	return size, writeSplitManifest(destination+splitSuffix, size, pieces)
+}
+
+// Copy a piece of the source, starting at offset, into its own file
+func copyPiece(src *os.File, p piece, offset int64, mode os.FileMode, threads int) error {
+	if err := checkDestType(p.name); err != nil {
+		return err
+	}
+	dst, err := openTarget(p.name, os.O_RDWR, mode)
+	if err != nil {
+		return err
+	}
+	err = dst.Truncate(0)
+	if err == nil {
+		err = dst.Truncate(p.size)
+	}
+	if err == nil {
+		err = copyRange(src, dst.File, offset, 0, p.size, threads)
+	}
+	return dst.finish(err)
+}
+
+// Write the manifest listing the pieces of a split copy
+func writeSplitManifest(path string, size int64, pieces []piece) error {
+	out, err := openTarget(path, os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	fmt.Fprintf(w, "%s pieces %d size %d\n", splitHeader, len(pieces), size)
+	for _, p := range pieces {
+		fmt.Fprintln(w, filepath.Base(p.name), p.size)
+	}
+	err = w.Flush()
+	return out.finish(err)
+}
+
+// Read a split manifest, resolving the pieces against its directory
+func readSplitManifest(path string) (int64, []piece, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+	var count, size int64
+	scanner := bufio.NewScanner(f)
+	if !scanner.Scan() {
+		return 0, nil, fmt.Errorf("%s is not a pcp split manifest", path)
+	}
+	_, err = fmt.Sscanf(scanner.Text(), splitHeader+" pieces %d size %d", &count, &size)
+	if err != nil || count <= 0 || size <= 0 {
+		return 0, nil, fmt.Errorf("%s is not a pcp split manifest", path)
+	}
+	var pieces []piece
+	var total int64
+	for line := 2; scanner.Scan(); line++ {
+		name, length, ok := strings.Cut(scanner.Text(), " ")
+		n, err := strconv.ParseInt(length, 10, 64)
+		if !ok || err != nil || n <= 0 || name == "" || strings.ContainsRune(name, '/') {
+			return 0, nil, fmt.Errorf("%s:%d: malformed piece line", path, line)
+		}
+		// Pieces after the first must start at page boundaries to be mapped
+		if total%pageSize != 0 {
+			return 0, nil, fmt.Errorf("%s:%d: piece starts at offset %d, not at a page boundary", path, line, total)
+		}
+		pieces = append(pieces, piece{filepath.Join(filepath.Dir(path), name), n})
+		total += n
+	}
+	if err = scanner.Err(); err != nil {
+		return 0, nil, err
+	}
+	if int64(len(pieces)) != count || total != size {
+		return 0, nil, fmt.Errorf("%s: %d pieces of %d bytes, expected %d of %d bytes", path, len(pieces), total, count, size)
+	}
+	return size, pieces, nil
+}
+
+// Reassemble the pieces listed in a split manifest into the destination
+func joinCopy(source, destination string, threads int) (int64, error) {
+	size, pieces, err := readSplitManifest(source)
+	if err != nil {
+		return 0, err
+	}
+	// All pieces must be complete before anything is written
+	var mode os.FileMode
+	for i, p := range pieces {
+		info, err := os.Stat(p.name)
+		if err != nil {
+			return 0, err
+		}
+		if !info.Mode().IsRegular() || info.Size() != p.size {
+			return 0, fmt.Errorf("piece %s has %d bytes, expected %d", p.name, info.Size(), p.size)
+		}
+		if i == 0 {
+			mode = info.Mode().Perm()
+		}
+	}
+	progress.total.Add(size)
+
+	dst, err := openTarget(destination, os.O_RDWR, mode)
+	if err != nil {
+		return 0, err
+	}
+	err = joinPieces(pieces, dst.File, size, threads)
+	if err != nil {
+		return 0, dst.finish(err)
+	}
+	return size, dst.finish(nil)
+}
+
+// Copy the pieces into the joined destination one after the other, each
+// by all the threads. Block devices are written in place.
+func joinPieces(pieces []piece, dst *os.File, size int64, threads int) error {
+	info, err := dst.Stat()
+	if err != nil {
+		return err
+	}
+	if isBlockDevice(info) {
+		devSize, err := deviceSize(dst)
+		if err != nil {
+			return err
+		}
+		if size > devSize {
+			return fmt.Errorf("pieces of %d bytes don't fit in the %d bytes of device %s", size, devSize, dst.Name())
+		}
+	} else {
+		err = dst.Truncate(0)
+		if err == nil {
+			err = dst.Truncate(size)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	var offset int64
+	for _, p := range pieces {
+		err = joinPiece(p, dst, offset, threads)
+		if err != nil {
+			return err
+		}
+		offset += p.size
+	}
+	return nil
+}
+
+// Copy a piece into the joined destination at offset
+func joinPiece(p piece, dst *os.File, offset int64, threads int) error {
+	src, err := os.Open(p.name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return copyRange(src, dst, 0, offset, p.size, threads)
+}
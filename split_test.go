@@ -0,0 +1,78 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestSplitJoin(t *testing.T) {
+	setFlag(t, "f", "true")
+	setFlag(t, "min-chunk", strconv.FormatInt(pageSize, 10))
+	dir := t.TempDir()
+	split := 16 * pageSize
+	for _, size := range []int64{1, pageSize, split, split + 1, 5*split - 3} {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", size))
+		data := writeRandom(t, src, size)
+		dst := src + ".part"
+
+		setFlag(t, "split", strconv.FormatInt(split, 10))
+		if _, err := copyFile(src, dst, 4); err != nil {
+			t.Fatalf("%d bytes: split: %v", size, err)
+		}
+		total, pieces, err := readSplitManifest(dst + splitSuffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := (size + split - 1) / split; total != size || int64(len(pieces)) != want {
+			t.Fatalf("%d bytes: manifest of %d pieces of %d bytes, want %d", size, len(pieces), total, want)
+		}
+		for i, p := range pieces {
+			if want := fmt.Sprintf("%s.%03d", dst, i); p.name != want {
+				t.Errorf("piece %d is %s, want %s", i, p.name, want)
+			}
+			assertData(t, p.name, data[int64(i)*split:int64(i)*split+p.size])
+		}
+
+		setFlag(t, "split", "0")
+		setFlag(t, "join", "true")
+		joined := src + ".joined"
+		if _, err := copyFile(dst+splitSuffix, joined, 4); err != nil {
+			t.Fatalf("%d bytes: join: %v", size, err)
+		}
+		assertData(t, joined, data)
+		setFlag(t, "join", "false")
+	}
+}
+
+func TestJoinIncompletePiece(t *testing.T) {
+	setFlag(t, "f", "true")
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeRandom(t, src, 3*pageSize)
+	setFlag(t, "split", strconv.FormatInt(pageSize, 10))
+	if _, err := copyFile(src, src+".part", 1); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "split", "0")
+	if err := os.Truncate(src+".part.001", pageSize-1); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "join", "true")
+	joined := filepath.Join(dir, "joined")
+	if _, err := copyFile(src+".part"+splitSuffix, joined, 1); err == nil {
+		t.Fatal("joined a manifest with a truncated piece")
+	}
+	if _, err := os.Stat(joined); !os.IsNotExist(err) {
+		t.Errorf("failed join created the destination: %v", err)
+	}
+}
@@ -0,0 +1,36 @@
+//go:build linux || darwin || freebsd || dragonfly
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Get the space available to unprivileged users in the filesystem of path
+func freeSpace(path string) (int64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// Get the free inodes in the filesystem of path, or ENOSYS when the
+// filesystem allocates inodes dynamically and reports no inode count
+func freeInodes(path string) (int64, error) {
+	var st unix.Statfs_t
+	err := unix.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+	if st.Files == 0 {
+		return 0, unix.ENOSYS
+	}
+	return int64(st.Ffree), nil
+}
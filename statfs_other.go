@@ -0,0 +1,22 @@
+//go:build !linux && !darwin && !freebsd && !dragonfly
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import "golang.org/x/sys/unix"
+
+// Free space checks are not implemented on this platform
+func freeSpace(path string) (int64, error) {
+	return 0, unix.ENOSYS
+}
+
+// Free inode checks are not implemented on this platform
+func freeInodes(path string) (int64, error) {
+	return 0, unix.ENOSYS
+}
@@ -0,0 +1,128 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Copy data sequentially at an offset of the destination until the end of the source
+func scopy(src, dst *os.File, dstOffset int64) (int64, error) {
+	_, err := dst.Seek(dstOffset, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, streamReader(src))
+	if err == nil && *syncData {
+		err = dst.Sync()
+	}
+	return n, err
+}
+
+// Time a followed source must stop growing before the copy is done
+const followGrace = 2 * time.Second
+
+// Copy data appended to a growing source after the first size bytes to the
+// end of the destination, until the source stops growing for the grace
+// period or the follow timeout expires.
+func follow(src, dst *os.File, size int64) (int64, error) {
+	var copied int64
+	var grown bool
+	deadline := time.Now().Add(*followTimeout)
+	idle := time.Now()
+	for time.Now().Before(deadline) && time.Since(idle) < followGrace {
+		time.Sleep(followGrace / 10)
+		stat, err := src.Stat()
+		if err != nil {
+			return copied, err
+		}
+		if stat.Size() <= size {
+			continue
+		}
+		_, err = dst.Seek(0, io.SeekEnd)
+		if err != nil {
+			return copied, err
+		}
+		progress.total.Add(stat.Size() - size)
+		var r io.Reader = progressReader{io.NewSectionReader(src, size, stat.Size()-size)}
+		if *showCRC {
+			r = &crcReader{Reader: r, offset: size}
+		}
+		n, err := io.Copy(dst, r)
+		copied += n
+		if err != nil {
+			return copied, err
+		}
+		if *syncData {
+			err = dst.Sync()
+			if err != nil {
+				return copied, err
+			}
+		}
+		size += n
+		idle = time.Now()
+		grown = true
+	}
+	if grown && time.Since(idle) < followGrace {
+		log.Println(src.Name(), "is still growing, stopped following after", *followTimeout)
+	}
+	return copied, nil
+}
+
+// Stream the source into a named pipe, failing with a clear error
+// when the reader closes the pipe before all data is written
+func pipeCopy(src, dst *os.File) (int64, error) {
+	if *appendMode || *delta || *metadataOnly || *followSource {
+		return 0, fmt.Errorf("%s is a named pipe, -append, -delta, -metadata-only and -follow need a file", dst.Name())
+	}
+	n, err := io.Copy(dst, streamReader(src))
+	if errors.Is(err, unix.EPIPE) {
+		return n, fmt.Errorf("%s: reader closed the pipe after %d bytes", dst.Name(), n)
+	}
+	return n, err
+}
+
+// Reader that asks the kernel to read a window of the file ahead of the
+// current position, renewing the hint when half of the window is consumed
+type readaheadReader struct {
+	f      *os.File
+	window int64
+	pos    int64 // bytes read so far
+	hinted int64 // end of the range already hinted
+}
+
+func (r *readaheadReader) Read(p []byte) (int, error) {
+	if r.pos+r.window/2 >= r.hinted {
+		// Only a hint, pipes and unsupported systems ignore it
+		willNeed(r.f, r.hinted, r.pos+r.window-r.hinted)
+		r.hinted = r.pos + r.window
+	}
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	return n, err
+}
+
+// Get the reader of a streamed source, with read ahead hints and the CRC32C
+// when enabled
+func streamReader(src *os.File) io.Reader {
+	var r io.Reader = progressReader{src}
+	if *readahead > 0 {
+		r = progressReader{&readaheadReader{f: src, window: *readahead}}
+	}
+	if *showCRC {
+		r = &crcReader{Reader: r}
+	}
+	return r
+}
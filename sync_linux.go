@@ -0,0 +1,27 @@
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Write out a file range to disk and wait for it to complete
+func syncRange(f *os.File, offset, size int64) error {
+	return unix.SyncFileRange(int(f.Fd()), offset, size,
+		unix.SYNC_FILE_RANGE_WAIT_BEFORE|unix.SYNC_FILE_RANGE_WRITE|unix.SYNC_FILE_RANGE_WAIT_AFTER)
+}
+
+// Make the ranges written out by syncRange durable. sync_file_range flushes
+// neither the metadata, like the size and the allocated blocks, nor the
+// volatile cache of the device, fdatasync does both once the data is out.
+func syncRangeDone(f *os.File) error {
+	return unix.Fdatasync(int(f.Fd()))
+}
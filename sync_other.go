@@ -0,0 +1,26 @@
+//go:build !linux
+
+/*
+	Copyright (C) 2022, Lefteris Zafiris <zaf@fastmail.com>
+	This program is free software, distributed under the terms of
+	the GNU GPL v3 License. See the LICENSE file
+	at the top of the source tree.
+*/
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// sync_file_range is Linux only, callers fall back to msync
+func syncRange(f *os.File, offset, size int64) error {
+	return unix.ENOSYS
+}
+
+// The ranges were synced by the fallback, nothing is left to flush
+func syncRangeDone(f *os.File) error {
+	return nil
+}